@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RestoredMount is what became of one mount record on restore
+type RestoredMount struct {
+	MountPoint string
+	Mode       string
+	Err        error // why it could not be mounted again
+	Kept       bool  // the record was kept despite Err, as it holds changes
+}
+
+// RestoreMounts mounts everything that is recorded as mounted but is not,
+// typically after a reboot, the way it was mounted before. Records that
+// cannot be restored are cleared, unless they hold changes: a workspace
+// or ephemeral mount like that keeps its record, to be unmounted with
+// --promote or --discard.
+func (gt *GoTree) RestoreMounts() ([]RestoredMount, error) {
+	entries, err := gt.ListMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []RestoredMount
+	for _, e := range entries {
+		if !e.Stale {
+			continue
+		}
+		rec := e.mountRecord
+		result := RestoredMount{MountPoint: rec.MountPoint, Mode: rec.Mode}
+		if result.Mode == "" {
+			result.Mode = "rw"
+		}
+		if err := gt.restoreMount(&rec); err != nil {
+			result.Err = err
+			if gt.mountHoldsChanges(&rec) {
+				result.Kept = true
+			} else if rmErr := gt.forgetMount(rec.MountPoint); rmErr != nil {
+				result.Err = fmt.Errorf("%v; failed to clear its record: %w", err, rmErr)
+			}
+		} else {
+			// The record shows who mounted it this time
+			rec.PID = os.Getpid()
+			rec.Created = time.Now()
+			if err := gt.saveMountRecord(&rec); err != nil {
+				result.Err = err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// mountHoldsChanges reports whether a workspace or ephemeral mount has
+// changes that would be lost with its record
+func (gt *GoTree) mountHoldsChanges(rec *mountRecord) bool {
+	if rec.Workspace != "" && gt.layerExists(rec.Workspace) {
+		return gt.workspaceDirty(rec.Workspace)
+	}
+	if rec.Scratch != "" {
+		names, err := readDirNames(filepath.Join(rec.Scratch, "upper"))
+		return err == nil && len(names) > 0
+	}
+	return false
+}
+
+func (gt *GoTree) restoreMount(rec *mountRecord) error {
+	for _, layerID := range rec.Layers {
+		if !gt.layerExists(layerID) {
+			return fmt.Errorf("layer %s is gone", layerID)
+		}
+	}
+	// Overlayfs leaves it undefined what a mount shows when one of its
+	// lower dirs is the upper dir of another, so whichever of the two comes
+	// back first keeps the ref's upper layer
+	if ref, err := gt.getRef(rec.Ref); err == nil {
+		if rec.writesToRef() {
+			readers, err := gt.mountsOnUpper(ref)
+			if err != nil {
+				return err
+			}
+			if len(readers) > 0 {
+				return fmt.Errorf("ref '%s' is mounted on %s on top of its upper layer", rec.Ref, strings.Join(readers, ", "))
+			}
+		} else if containsString(rec.Layers, ref.LayerID) {
+			mp, err := gt.liveWritableMount(rec.Ref)
+			if err != nil {
+				return err
+			}
+			if mp != "" {
+				return fmt.Errorf("ref '%s' is mounted writable on %s", rec.Ref, mp)
+			}
+		}
+	}
+	if err := os.MkdirAll(rec.MountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	switch rec.Mode {
+	case "ro":
+		return gt.mountReadOnly(rec.Layers, rec.MountPoint)
+
+	case "ephemeral":
+		// The changes on a tmpfs did not survive, so it starts out empty
+		if err := os.MkdirAll(rec.Scratch, 0700); err != nil {
+			return fmt.Errorf("failed to create scratch directory: %w", err)
+		}
+		if rec.Tmpfs && !gt.isMounted(rec.Scratch) {
+			if err := syscall.Mount("tmpfs", rec.Scratch, "tmpfs", 0, "mode=0700"); err != nil {
+				return fmt.Errorf("failed to mount tmpfs: %w", err)
+			}
+		}
+		return gt.mountScratchOverlay(rec, rec.MountPoint)
+
+	case "workspace":
+		if !gt.layerExists(rec.Workspace) {
+			return fmt.Errorf("workspace layer %s is gone", rec.Workspace)
+		}
+		return gt.mountWorkspace(rec, rec.MountPoint)
+
+	default:
+		ref, err := gt.getRef(rec.Ref)
+		if err != nil {
+			return fmt.Errorf("ref '%s' is gone", rec.Ref)
+		}
+		mp, err := gt.liveWritableMount(rec.Ref)
+		if err != nil {
+			return err
+		}
+		if mp != "" {
+			return fmt.Errorf("ref '%s' is already mounted writable on %s", rec.Ref, mp)
+		}
+		return gt.mountOverlay(ref, rec.MountPoint)
+	}
+}
+
+// Automount is a ref to mount at boot. A ref is marked with the metadata
+// key "automount" set to the mount point, and "automount.options" set to
+// a comma separated list of ro, ephemeral, tmpfs or workspace.
+type Automount struct {
+	Ref        string
+	MountPoint string
+	Options    []string
+}
+
+// Automounts returns the refs marked for mounting at boot, sorted by
+// mount point. Two refs marked for the same mount point, or options the
+// mount command would refuse, are an error.
+func (gt *GoTree) Automounts() ([]Automount, error) {
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []Automount
+	for _, ref := range refs {
+		mountPoint := ref.Metadata["automount"]
+		if mountPoint == "" {
+			continue
+		}
+		if !filepath.IsAbs(mountPoint) {
+			return nil, fmt.Errorf("ref '%s': automount path %s is not absolute", ref.Name, mountPoint)
+		}
+		m := Automount{Ref: ref.Name, MountPoint: filepath.Clean(mountPoint)}
+		if options := ref.Metadata["automount.options"]; options != "" {
+			flags := make(map[string]bool)
+			for _, opt := range strings.Split(options, ",") {
+				flag, ok := mountHelperFlags[opt]
+				if !ok {
+					return nil, fmt.Errorf("ref '%s': unknown automount option %s", ref.Name, opt)
+				}
+				flags[flag] = true
+				m.Options = append(m.Options, opt)
+			}
+			if err := checkMountFlags(func(flag string) bool { return flags[flag] }); err != nil {
+				return nil, fmt.Errorf("ref '%s': automount options %s: %w", ref.Name, options, err)
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		if mounts[i].MountPoint != mounts[j].MountPoint {
+			return mounts[i].MountPoint < mounts[j].MountPoint
+		}
+		return mounts[i].Ref < mounts[j].Ref
+	})
+	for i := 1; i < len(mounts); i++ {
+		if mounts[i].MountPoint == mounts[i-1].MountPoint {
+			return nil, fmt.Errorf("refs '%s' and '%s' are both marked for automount on %s", mounts[i-1].Ref, mounts[i].Ref, mounts[i].MountPoint)
+		}
+	}
+	return mounts, nil
+}
+
+// inheritMetadata copies the metadata of the ref, commit or image a new
+// ref starts from into dst. The automount keys stay behind: a mount point
+// belongs to the one ref that was marked for it.
+func inheritMetadata(dst, src map[string]string) {
+	for k, v := range src {
+		if k == "automount" || k == "automount.options" {
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// mountSource is what fstab and mount units give as the device: the
+// absolute repository path and the ref, which mount.gotree splits again
+func (gt *GoTree) mountSource(refName string) (string, error) {
+	repo, err := filepath.Abs(gt.repoPath)
+	if err != nil {
+		return "", err
+	}
+	return repo + ":" + refName, nil
+}
+
+// writeFstab writes an fstab line of type gotree for every automount
+func (gt *GoTree) writeFstab(w io.Writer, mounts []Automount) error {
+	for _, m := range mounts {
+		source, err := gt.mountSource(m.Ref)
+		if err != nil {
+			return err
+		}
+		options := "defaults"
+		if len(m.Options) > 0 {
+			options = strings.Join(m.Options, ",")
+		}
+		fmt.Fprintf(w, "%s %s gotree %s 0 0\n", escapeFstab(source), escapeFstab(m.MountPoint), options)
+	}
+	return nil
+}
+
+// WriteMountUnits writes a systemd .mount unit of type gotree for every
+// automount into dir and returns the paths of the units
+func (gt *GoTree) WriteMountUnits(dir string, mounts []Automount) ([]string, error) {
+	repo, err := filepath.Abs(gt.repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, m := range mounts {
+		source, err := gt.mountSource(m.Ref)
+		if err != nil {
+			return paths, err
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Generated by gotree from the automount metadata of ref %s\n", m.Ref)
+		fmt.Fprintf(&b, "[Unit]\nDescription=gotree ref %s\nRequiresMountsFor=%s\n\n", m.Ref, repo)
+		fmt.Fprintf(&b, "[Mount]\nWhat=%s\nWhere=%s\nType=gotree\n", source, m.MountPoint)
+		if len(m.Options) > 0 {
+			fmt.Fprintf(&b, "Options=%s\n", strings.Join(m.Options, ","))
+		}
+		fmt.Fprintf(&b, "\n[Install]\nWantedBy=local-fs.target\n")
+
+		path := filepath.Join(dir, mountUnitName(m.MountPoint))
+		if err := writeFileAtomic(path, []byte(b.String()), 0644); err != nil {
+			return paths, fmt.Errorf("failed to write mount unit: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// mountUnitName is the unit name systemd requires for a mount point, as
+// systemd-escape --path --suffix=mount makes it
+func mountUnitName(mountPoint string) string {
+	p := strings.Trim(filepath.Clean(mountPoint), "/")
+	if p == "" {
+		return "-.mount"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == ':', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		}
+	}
+	return b.String() + ".mount"
+}
+
+// escapeFstab escapes the characters that would split an fstab field
+func escapeFstab(s string) string {
+	return strings.NewReplacer(" ", "\\040", "\t", "\\011", "\n", "\\012", "\\", "\\134").Replace(s)
+}
+
+// mountHelperFlags maps the options gotree understands in fstab and mount
+// units to mount command flags
+var mountHelperFlags = map[string]string{
+	"ro":        "--read-only",
+	"ephemeral": "--ephemeral",
+	"tmpfs":     "--tmpfs",
+	"workspace": "--workspace",
+}
+
+// checkMountFlags applies the rules of the mount command to the flags has
+// reports as given: one mode at most, and --tmpfs only with --ephemeral
+func checkMountFlags(has func(flag string) bool) error {
+	var modes []string
+	for _, flag := range []string{"--read-only", "--ephemeral", "--workspace", "--restore"} {
+		if has(flag) {
+			modes = append(modes, flag)
+		}
+	}
+	if len(modes) > 1 {
+		return fmt.Errorf("%s cannot be combined", strings.Join(modes, " and "))
+	}
+	if has("--tmpfs") && !has("--ephemeral") {
+		return fmt.Errorf("--tmpfs needs --ephemeral")
+	}
+	return nil
+}
+
+// mountHelperArgs turns the arguments mount(8) passes to mount.gotree,
+// "<repo>:<ref> <dir> [-sfnv] [-o options]", into gotree arguments.
+// Options gotree has no use for, like defaults or nofail, are ignored.
+func mountHelperArgs(args []string) ([]string, error) {
+	var positional, flags []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" || arg == "-t":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag %s needs a value", arg)
+			}
+			i++
+			if arg == "-t" {
+				continue
+			}
+			for _, opt := range strings.Split(args[i], ",") {
+				if flag, ok := mountHelperFlags[opt]; ok {
+					flags = append(flags, flag)
+				}
+			}
+		case strings.HasPrefix(arg, "-"):
+			// -s, -f, -n and -v make no difference here
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("usage: mount.gotree <repo>:<ref> <mountpoint> [-o options]")
+	}
+
+	// Ref names cannot contain a colon, so the last one splits the source
+	i := strings.LastIndex(positional[0], ":")
+	if i <= 0 || i == len(positional[0])-1 {
+		return nil, fmt.Errorf("mount source %s is not <repo>:<ref>", positional[0])
+	}
+	repo, ref := positional[0][:i], positional[0][i+1:]
+	return append(append([]string{repo, "mount"}, flags...), ref, positional[1]), nil
+}
@@ -1,3 +1,3 @@
 #!/bin/bash
 
-go build -o gotree main.go
+go build -o gotree *.go
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Commit is an immutable record of one sealed layer in a ref's history
+type Commit struct {
+	ID        string            `json:"id"`
+	Parent    string            `json:"parent,omitempty"`
+	Ref       string            `json:"ref"`
+	LayerID   string            `json:"layer_id"`
+	Lower     []string          `json:"lower,omitempty"` // layers below LayerID at commit time, topmost first
+	Author    string            `json:"author"`
+	Message   string            `json:"message,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// ShortID returns the abbreviated commit ID used in one-line output
+func (c *Commit) ShortID() string {
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// Log returns the commit history of a ref, newest first
+func (gt *GoTree) Log(refName string) ([]Commit, error) {
+	ref, err := gt.getRef(refName)
+	if err != nil {
+		return nil, fmt.Errorf("ref not found: %w", err)
+	}
+
+	var commits []Commit
+	seen := make(map[string]bool)
+	for id := ref.Head; id != ""; {
+		if seen[id] {
+			return commits, fmt.Errorf("commit history of '%s' loops at %s", refName, id)
+		}
+		seen[id] = true
+
+		commit, err := gt.getCommit(id)
+		if err != nil {
+			return commits, fmt.Errorf("failed to read commit %s: %w", id, err)
+		}
+		commits = append(commits, *commit)
+		id = commit.Parent
+	}
+
+	return commits, nil
+}
+
+// newCommit records layerID, sealed on top of the lower layers, as a new
+// commit on top of the ref's head
+func (gt *GoTree) newCommit(ref *Ref, layerID string, lower []string, message string, timestamp time.Time) (*Commit, error) {
+	metadata := make(map[string]string)
+	for k, v := range ref.Metadata {
+		metadata[k] = v
+	}
+
+	commit := &Commit{
+		Parent:    ref.Head,
+		Ref:       ref.Name,
+		LayerID:   layerID,
+		Lower:     lower,
+		Author:    currentUser(),
+		Message:   message,
+		Timestamp: timestamp,
+		Metadata:  metadata,
+	}
+
+	// The ID is the hash of the commit contents, like git
+	data, err := json.Marshal(commit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal commit: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	commit.ID = hex.EncodeToString(sum[:])
+
+	if err := gt.saveCommit(commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+func (gt *GoTree) saveCommit(commit *Commit) error {
+	data, err := json.MarshalIndent(commit, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal commit: %w", err)
+	}
+
+	commitPath := filepath.Join(gt.repoPath, "commits", commit.ID+".json")
+	if err := writeFileAtomic(commitPath, data, 0444); err != nil {
+		return fmt.Errorf("failed to save commit: %w", err)
+	}
+	return nil
+}
+
+func (gt *GoTree) getCommit(id string) (*Commit, error) {
+	data, err := os.ReadFile(filepath.Join(gt.repoPath, "commits", id+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var commit Commit
+	if err := json.Unmarshal(data, &commit); err != nil {
+		return nil, err
+	}
+
+	return &commit, nil
+}
+
+// currentUser names the person running gotree, looking through sudo
+func currentUser() string {
+	if name := os.Getenv("GOTREE_AUTHOR"); name != "" {
+		return name
+	}
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid %d", os.Getuid())
+}
+
+// firstLine returns the first line of a commit message
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
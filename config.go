@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config holds repository-wide settings, stored in config.json
+type Config struct {
+	// ObjectStore selects how sealed layers share files with the object
+	// store: "" (disabled), "hardlink" or "reflink"
+	ObjectStore string `json:"object_store,omitempty"`
+	// LockTimeout is how long commands wait for a lock, such as "30s" or
+	// "5m"; GOTREE_LOCK_TIMEOUT overrides it
+	LockTimeout string `json:"lock_timeout,omitempty"`
+}
+
+// configKeys lists the settings accepted by the config command
+var configKeys = []string{"object_store", "lock_timeout"}
+
+func (gt *GoTree) loadConfig() error {
+	data, err := os.ReadFile(filepath.Join(gt.repoPath, "config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &gt.config); err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	return nil
+}
+
+func (gt *GoTree) saveConfig() error {
+	data, err := json.MarshalIndent(gt.config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(gt.repoPath, "config.json"), data, 0644)
+}
+
+// GetConfig returns the value of a repository setting
+func (gt *GoTree) GetConfig(key string) (string, error) {
+	switch key {
+	case "object_store":
+		return gt.config.ObjectStore, nil
+	case "lock_timeout":
+		return gt.config.LockTimeout, nil
+	}
+	return "", fmt.Errorf("unknown config key: %s", key)
+}
+
+// SetConfig changes a repository setting
+func (gt *GoTree) SetConfig(key, value string) error {
+	switch key {
+	case "object_store":
+		switch value {
+		case "", "off":
+			value = ""
+		case "hardlink", "reflink":
+		default:
+			return fmt.Errorf("object_store must be off, hardlink or reflink")
+		}
+		gt.config.ObjectStore = value
+	case "lock_timeout":
+		if value != "" {
+			if _, err := parseAge(value); err != nil {
+				return fmt.Errorf("lock_timeout must be a duration such as 30s, 5m or 1d")
+			}
+		}
+		gt.config.LockTimeout = value
+	default:
+		return fmt.Errorf("unknown config key: %s", key)
+	}
+	return gt.saveConfig()
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Change kinds reported when two versions of a path are compared
+const (
+	changeNone     = ""
+	changeModified = "modified" // type, content or link target differ
+	changeMetadata = "metadata" // only mode, ownership or xattrs differ
+)
+
+// compareEntries compares two versions of a path. Times are ignored, as
+// are overlayfs private xattrs; directories are compared by metadata only.
+func compareEntries(aPath string, aInfo os.FileInfo, bPath string, bInfo os.FileInfo) (string, error) {
+	if aInfo.Mode().Type() != bInfo.Mode().Type() {
+		return changeModified, nil
+	}
+
+	switch {
+	case aInfo.Mode().IsRegular():
+		same, err := sameContent(aPath, aInfo, bPath, bInfo)
+		if err != nil {
+			return "", err
+		}
+		if !same {
+			return changeModified, nil
+		}
+	case aInfo.Mode()&os.ModeSymlink != 0:
+		aTarget, err := os.Readlink(aPath)
+		if err != nil {
+			return "", err
+		}
+		bTarget, err := os.Readlink(bPath)
+		if err != nil {
+			return "", err
+		}
+		if aTarget != bTarget {
+			return changeModified, nil
+		}
+	case aInfo.Mode()&os.ModeDevice != 0:
+		if rdev(aInfo) != rdev(bInfo) {
+			return changeModified, nil
+		}
+	}
+
+	aAttrs, err := attrsFromInfo(aPath, aInfo)
+	if err != nil {
+		return "", err
+	}
+	bAttrs, err := attrsFromInfo(bPath, bInfo)
+	if err != nil {
+		return "", err
+	}
+	if aAttrs.mode != bAttrs.mode || aAttrs.uid != bAttrs.uid || aAttrs.gid != bAttrs.gid ||
+		!sameXattrs(aAttrs.xattrs, bAttrs.xattrs) {
+		return changeMetadata, nil
+	}
+	return changeNone, nil
+}
+
+func rdev(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Rdev)
+	}
+	return 0
+}
+
+func sameXattrs(a, b map[string][]byte) bool {
+	count := 0
+	for name, value := range a {
+		if isOverlayXattr(name) {
+			continue
+		}
+		count++
+		if other, ok := b[name]; !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	for name := range b {
+		if !isOverlayXattr(name) {
+			count--
+		}
+	}
+	return count == 0
+}
+
+// sameContent compares two regular files byte by byte
+func sameContent(aPath string, aInfo os.FileInfo, bPath string, bInfo os.FileInfo) (bool, error) {
+	if aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+	if os.SameFile(aInfo, bInfo) {
+		return true, nil
+	}
+
+	a, err := os.Open(aPath)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := os.Open(bPath)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	aBuf := make([]byte, 64*1024)
+	bBuf := make([]byte, 64*1024)
+	for {
+		an, aErr := io.ReadFull(a, aBuf)
+		bn, bErr := io.ReadFull(b, bBuf)
+		if an != bn || !bytes.Equal(aBuf[:an], bBuf[:bn]) {
+			return false, nil
+		}
+		if aErr == io.EOF || aErr == io.ErrUnexpectedEOF {
+			return bErr == aErr, nil
+		}
+		if aErr != nil {
+			return false, aErr
+		}
+		if bErr != nil {
+			return false, bErr
+		}
+	}
+}
+
+// copyEntry creates dst as a copy of the file, directory, symlink or
+// device at src, with its attributes. A directory is created empty.
+// Regular files are reflinked when reflink is set and the filesystem
+// allows it.
+func copyEntry(src, dst string, info os.FileInfo, reflink bool) error {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case mode.IsRegular():
+		if err := copyFileData(src, dst, reflink); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	default:
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot copy special file %s", src)
+		}
+		if err := syscall.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+			return err
+		}
+	}
+
+	attrs, err := attrsFromInfo(src, info)
+	if err != nil {
+		return err
+	}
+	return attrs.apply(dst)
+}
+
+func copyFileData(src, dst string, reflink bool) error {
+	if reflink {
+		if err := reflinkFile(src, dst, 0600); err == nil {
+			return nil
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyTree copies the directory tree at src to dst, which must not exist,
+// keeping attributes and hardlinks. Files whose inode is in objects belong
+// to the object store and are copied separately.
+func copyTree(src, dst string, reflink bool, objects map[[2]uint64]bool) error {
+	links := make(map[[2]uint64]string)
+	var dirs []string
+	var dirAttrs []fileAttrs
+
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() && st.Nlink > 1 &&
+			!objects[[2]uint64{uint64(st.Dev), st.Ino}] {
+			key := [2]uint64{uint64(st.Dev), st.Ino}
+			if first, ok := links[key]; ok {
+				return os.Link(first, target)
+			}
+			links[key] = target
+		}
+
+		if err := copyEntry(p, target, info, reflink); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", p, err)
+		}
+		if info.IsDir() {
+			attrs, err := attrsFromInfo(p, info)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, target)
+			dirAttrs = append(dirAttrs, attrs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Creating children bumped the directory times, so set them last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := lutimes(dirs[i], dirAttrs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergedEntry is one path of a merged view
+type mergedEntry struct {
+	Path string
+	Info os.FileInfo
+}
+
+// mergedView is the merged view of a layer stack, indexed by relative path
+type mergedView struct {
+	entries  map[string]mergedEntry
+	children map[string][]string
+}
+
+// readMergedView walks a layer stack (topmost first) into a mergedView
+func readMergedView(layers []string) (*mergedView, error) {
+	view := &mergedView{
+		entries:  make(map[string]mergedEntry),
+		children: make(map[string][]string),
+	}
+	err := walkMerged(layers, func(rel, path string, info os.FileInfo, layer int) error {
+		view.entries[rel] = mergedEntry{Path: path, Info: info}
+		if rel != "." {
+			parent := filepath.Dir(rel)
+			view.children[parent] = append(view.children[parent], filepath.Base(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// paths returns every path of the view in lexical order
+func (v *mergedView) paths() []string {
+	paths := make([]string, 0, len(v.entries))
+	for rel := range v.entries {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// deltaWriter turns a full tree into an overlay layer holding only what
+// differs from a lower merged view. Changed entries are moved, not copied,
+// out of the source tree, which is consumed in the process.
+type deltaWriter struct {
+	lower *mergedView
+	src   string
+	layer string
+	dirs  []string // layer directories whose times still need fixing
+	times []fileAttrs
+}
+
+// writeDelta fills layer with the difference between the tree at src and
+// the lower view, using whiteouts for paths missing from src
+func writeDelta(lower *mergedView, src, layer string) error {
+	d := &deltaWriter{lower: lower, src: src, layer: layer}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	attrs, err := attrsFromInfo(src, info)
+	if err != nil {
+		return err
+	}
+	if err := attrs.apply(layer); err != nil {
+		return err
+	}
+
+	if err := d.dir("."); err != nil {
+		return err
+	}
+
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		if err := lutimes(d.dirs[i], d.times[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deltaWriter) dir(rel string) error {
+	names, err := readDirNames(filepath.Join(d.src, rel))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+		crel := filepath.Join(rel, name)
+		srcPath := filepath.Join(d.src, crel)
+		info, err := os.Lstat(srcPath)
+		if err != nil {
+			return err
+		}
+
+		lower, ok := d.lower.entries[crel]
+		if ok && lower.Info.IsDir() && info.IsDir() {
+			change, err := compareEntries(lower.Path, lower.Info, srcPath, info)
+			if err != nil {
+				return err
+			}
+			if change != changeNone {
+				if err := d.ensureDir(crel); err != nil {
+					return err
+				}
+			}
+			if err := d.dir(crel); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ok {
+			change, err := compareEntries(lower.Path, lower.Info, srcPath, info)
+			if err != nil {
+				return err
+			}
+			if change == changeNone {
+				continue
+			}
+		}
+
+		// New or replaced entry: move it, with everything below it
+		if err := d.ensureDir(rel); err != nil {
+			return err
+		}
+		if err := os.Rename(srcPath, filepath.Join(d.layer, crel)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range d.lower.children[rel] {
+		if present[name] {
+			continue
+		}
+		if err := d.ensureDir(rel); err != nil {
+			return err
+		}
+		if err := makeWhiteout(filepath.Join(d.layer, rel, name)); err != nil {
+			return fmt.Errorf("failed to create whiteout for %s: %w", filepath.Join(rel, name), err)
+		}
+	}
+
+	return nil
+}
+
+// ensureDir creates rel and its parents in the layer, with the attributes
+// they have in the source tree
+func (d *deltaWriter) ensureDir(rel string) error {
+	layerPath := filepath.Join(d.layer, rel)
+	if _, err := os.Lstat(layerPath); err == nil {
+		return nil
+	}
+	if err := d.ensureDir(filepath.Dir(rel)); err != nil {
+		return err
+	}
+
+	srcPath := filepath.Join(d.src, rel)
+	info, err := os.Lstat(srcPath)
+	if err != nil {
+		return err
+	}
+	if err := copyEntry(srcPath, layerPath, info, false); err != nil {
+		return err
+	}
+	attrs, err := attrsFromInfo(srcPath, info)
+	if err != nil {
+		return err
+	}
+	d.dirs = append(d.dirs, layerPath)
+	d.times = append(d.times, attrs)
+	return nil
+}
+
+// flattenStack copies the merged view of a layer stack (topmost first) into
+// dst as one self-contained layer, with no whiteouts. As in copyTree, files
+// linked to the object store are not taken for hardlinks.
+func flattenStack(layers []string, dst string, objects map[[2]uint64]bool) error {
+	type inode struct {
+		layer    int
+		dev, ino uint64
+	}
+	links := make(map[inode]string)
+	var dirs []string
+	var dirTimes []fileAttrs
+
+	err := walkMerged(layers, func(rel, path string, info os.FileInfo, layer int) error {
+		target := filepath.Join(dst, rel)
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 &&
+			!objects[[2]uint64{uint64(st.Dev), st.Ino}] {
+			key := inode{layer: layer, dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := links[key]; ok {
+				return os.Link(first, target)
+			}
+			links[key] = target
+		}
+
+		if err := copyEntry(path, target, info, true); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", rel, err)
+		}
+		if info.IsDir() {
+			// The merged view needs no overlay markers
+			if err := removeXattr(target, opaqueXattr); err != nil && err != syscall.ENODATA {
+				return err
+			}
+			attrs, err := attrsFromInfo(path, info)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, target)
+			dirTimes = append(dirTimes, attrs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := lutimes(dirs[i], dirTimes[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyLayer applies the overlay layer src on top of the layer dst, the
+// way overlayfs would stack them, so dst ends up equivalent to both.
+// Whiteouts and opaque directories are kept: they still hide whatever
+// lies below dst.
+func applyLayer(src, dst string) error {
+	var dirs []string
+	var dirTimes []fileAttrs
+
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		existing, err := os.Lstat(target)
+		exists := err == nil
+		if info.IsDir() && rel != "." && (!exists || !existing.IsDir() || isOpaque(p)) {
+			if exists {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+		} else if !info.IsDir() && exists {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		if err := copyEntry(p, target, info, true); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", rel, err)
+		}
+		if info.IsDir() {
+			// A directory over a whiteout or a file hides whatever lies
+			// further down, as overlayfs stops looking there
+			if exists && !existing.IsDir() {
+				if err := setXattr(target, opaqueXattr, []byte("y")); err != nil {
+					return err
+				}
+			}
+			attrs, err := attrsFromInfo(p, info)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, target)
+			dirTimes = append(dirTimes, attrs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := lutimes(dirs[i], dirTimes[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Diff change kinds
+const (
+	diffAdded    = "added"
+	diffModified = "modified"
+	diffDeleted  = "deleted"
+	diffMetadata = "metadata"
+)
+
+// DiffEntry is one path that differs between two trees
+type DiffEntry struct {
+	Path    string `json:"path"`
+	Change  string `json:"change"`
+	Type    string `json:"type"`
+	OldSize int64  `json:"old_size,omitempty"`
+	NewSize int64  `json:"new_size,omitempty"`
+}
+
+// Diff compares the merged views of two refs. With refB empty it compares
+// the upper layer of refA against its lower layers, showing the changes
+// that have not been committed yet.
+func (gt *GoTree) Diff(refA, refB string) ([]DiffEntry, error) {
+	a, err := gt.getRef(refA)
+	if err != nil {
+		return nil, fmt.Errorf("ref not found: %w", err)
+	}
+
+	var oldStack, newStack []string
+	if refB == "" {
+		oldStack = gt.buildLowerDirs(a)
+		newStack = gt.refStack(a)
+	} else {
+		b, err := gt.getRef(refB)
+		if err != nil {
+			return nil, fmt.Errorf("ref not found: %w", err)
+		}
+		oldStack = gt.refStack(a)
+		newStack = gt.refStack(b)
+	}
+
+	oldView, err := readMergedView(oldStack)
+	if err != nil {
+		return nil, err
+	}
+	newView, err := readMergedView(newStack)
+	if err != nil {
+		return nil, err
+	}
+	return diffViews(oldView, newView)
+}
+
+// diffViews lists the paths that differ between two merged views
+func diffViews(oldView, newView *mergedView) ([]DiffEntry, error) {
+	var entries []DiffEntry
+
+	for _, rel := range oldView.paths() {
+		if rel == "." {
+			continue
+		}
+		o := oldView.entries[rel]
+		n, ok := newView.entries[rel]
+		if !ok {
+			entries = append(entries, DiffEntry{Path: rel, Change: diffDeleted, Type: fileType(o.Info), OldSize: fileSize(o.Info)})
+			continue
+		}
+		if o.Path == n.Path {
+			continue // both views get it from the same layer
+		}
+
+		change, err := compareEntries(o.Path, o.Info, n.Path, n.Info)
+		if err != nil {
+			return nil, err
+		}
+		switch change {
+		case changeModified:
+			entries = append(entries, DiffEntry{Path: rel, Change: diffModified, Type: fileType(n.Info),
+				OldSize: fileSize(o.Info), NewSize: fileSize(n.Info)})
+		case changeMetadata:
+			entries = append(entries, DiffEntry{Path: rel, Change: diffMetadata, Type: fileType(n.Info),
+				OldSize: fileSize(o.Info), NewSize: fileSize(n.Info)})
+		}
+	}
+
+	for _, rel := range newView.paths() {
+		if _, ok := oldView.entries[rel]; ok || rel == "." {
+			continue
+		}
+		n := newView.entries[rel]
+		entries = append(entries, DiffEntry{Path: rel, Change: diffAdded, Type: fileType(n.Info), NewSize: fileSize(n.Info)})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// fileType names the type of a file for diff output
+func fileType(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeCharDevice != 0:
+		return "char"
+	case mode&os.ModeDevice != 0:
+		return "block"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "unknown"
+}
+
+func fileSize(info os.FileInfo) int64 {
+	if info.Mode().IsRegular() {
+		return info.Size()
+	}
+	return 0
+}
+
+// diffLetter is the one-letter status used by the plain diff output
+func diffLetter(change string) string {
+	switch change {
+	case diffAdded:
+		return "A"
+	case diffModified:
+		return "M"
+	case diffDeleted:
+		return "D"
+	}
+	return "P" // properties: mode, ownership or xattrs
+}
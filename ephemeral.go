@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MountEphemeral mounts a ref with a throwaway upper dir under scratch/,
+// on a tmpfs when tmpfs is set. The ref's own upper layer becomes a lower
+// dir, so nothing written to the mount ever reaches the ref, and the ref
+// cannot be mounted writable at the same time. Unmounting discards the
+// changes unless they are promoted to a new ref first.
+func (gt *GoTree) MountEphemeral(refName, mountPoint string, tmpfs bool) error {
+	ref, err := gt.getRef(refName)
+	if err != nil {
+		return fmt.Errorf("ref not found: %w", err)
+	}
+	// The upper layer must not change under the mount
+	mp, err := gt.liveWritableMount(refName)
+	if err != nil {
+		return err
+	}
+	if mp != "" {
+		return fmt.Errorf("ref '%s' is mounted writable on %s; unmount it first", refName, mp)
+	}
+
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	if gt.isMounted(mountPoint) {
+		return fmt.Errorf("mount point already in use")
+	}
+	absPath, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	scratch := filepath.Join(gt.repoPath, "scratch", "mount"+strings.TrimPrefix(gt.generateLayerID(), "layer"))
+	if err := os.MkdirAll(scratch, 0700); err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	if tmpfs {
+		if err := syscall.Mount("tmpfs", scratch, "tmpfs", 0, "mode=0700"); err != nil {
+			os.RemoveAll(scratch)
+			return fmt.Errorf("failed to mount tmpfs: %w", err)
+		}
+	}
+
+	rec := &mountRecord{
+		Ref:        refName,
+		MountPoint: absPath,
+		Mode:       "ephemeral",
+		Layers:     append([]string{ref.LayerID}, gt.lowerLayerIDs(ref)...),
+		Scratch:    scratch,
+		Tmpfs:      tmpfs,
+	}
+	if err := gt.mountScratchOverlay(rec, mountPoint); err != nil {
+		gt.removeScratch(scratch)
+		return err
+	}
+	if err := gt.saveMountRecord(rec); err != nil {
+		syscall.Unmount(mountPoint, 0)
+		gt.removeScratch(scratch)
+		return err
+	}
+	return nil
+}
+
+// mountScratchOverlay mounts the layers of an ephemeral mount record with
+// the upper and work dirs in its scratch directory
+func (gt *GoTree) mountScratchOverlay(rec *mountRecord, mountPoint string) error {
+	upperDir := filepath.Join(rec.Scratch, "upper")
+	workDir := filepath.Join(rec.Scratch, "work")
+	for _, dir := range []string{upperDir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create scratch directory: %w", err)
+		}
+	}
+	// The root of the merged tree takes its attributes from the upper dir
+	if err := copyDirAttrs(filepath.Join(gt.repoPath, "layers", rec.Layers[0]), upperDir); err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(gt.layerPaths(rec.Layers), ":"), upperDir, workDir)
+	if err := syscall.Mount("overlay", mountPoint, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("failed to mount overlay: %w", err)
+	}
+	return nil
+}
+
+// removeScratch deletes the scratch directory of an ephemeral mount,
+// unmounting its tmpfs first if it has one
+func (gt *GoTree) removeScratch(dir string) error {
+	if gt.isMounted(dir) {
+		if err := syscall.Unmount(dir, 0); err != nil {
+			return fmt.Errorf("failed to unmount tmpfs %s: %w", dir, err)
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// PromoteMount unmounts an ephemeral or workspace mount and, instead of
+// discarding its changes, turns them into the upper layer of a new child
+// ref of the mounted ref
+func (gt *GoTree) PromoteMount(mountPoint, name string, force bool) error {
+	rec, err := gt.readMountRecord(mountPoint)
+	if err != nil || (rec.Mode != "ephemeral" && rec.Mode != "workspace") {
+		return fmt.Errorf("%s is not an ephemeral or workspace mount", mountPoint)
+	}
+	parent, err := gt.getRef(rec.Ref)
+	if err != nil {
+		return fmt.Errorf("parent ref not found: %w", err)
+	}
+	if err := gt.validateRefName(name); err != nil {
+		return err
+	}
+	if _, err := gt.getRef(name); err == nil {
+		return fmt.Errorf("ref '%s' already exists", name)
+	}
+
+	if gt.isMounted(mountPoint) {
+		if err := gt.detachMount(mountPoint, force); err != nil {
+			return err
+		}
+	}
+
+	metadata := make(map[string]string)
+	inheritMetadata(metadata, parent.Metadata)
+	ref := Ref{
+		Name:      name,
+		Parent:    parent.Name,
+		LayerID:   gt.generateLayerID(),
+		CreatedAt: time.Now(),
+		Metadata:  metadata,
+	}
+
+	// Until the ref is saved, the changes stay in the scratch directory or
+	// the workspace layer
+	upperDir := filepath.Join(rec.Scratch, "upper")
+	if rec.Mode == "workspace" {
+		ref.LayerID = rec.Workspace
+		upperDir = filepath.Join(gt.repoPath, "layers", rec.Workspace)
+	}
+	t, err := gt.beginTxn("promote " + name)
+	if err != nil {
+		return fmt.Errorf("%w; the changes are still in %s", err, upperDir)
+	}
+	fail := func(err error) error {
+		t.rollback()
+		return fmt.Errorf("%w; the changes are still in %s", err, upperDir)
+	}
+
+	layerPath := filepath.Join(gt.repoPath, "layers", ref.LayerID)
+	if layerPath != upperDir {
+		if err := t.moving(upperDir, layerPath); err != nil {
+			return fail(err)
+		}
+		if err := os.Rename(upperDir, layerPath); err != nil {
+			// A tmpfs upper cannot be renamed into the repository
+			if err := t.creating(layerPath); err != nil {
+				return fail(err)
+			}
+			if err := copyTree(upperDir, layerPath, false, nil); err != nil {
+				return fail(fmt.Errorf("failed to copy changes: %w", err))
+			}
+		}
+	}
+	if err := t.changingRef(name); err != nil {
+		return fail(err)
+	}
+	if err := gt.saveRef(ref, "promote "+rec.Mode+" mount of "+parent.Name); err != nil {
+		return fail(err)
+	}
+	t.done()
+
+	if rec.Mode == "workspace" {
+		// The workspace layer belongs to the new ref now, so only the
+		// record goes
+		if err := os.Remove(rec.path); err != nil {
+			return fmt.Errorf("failed to remove mount record: %w", err)
+		}
+		return nil
+	}
+	return gt.forgetMount(mountPoint)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Export writes the merged filesystem of a ref as a tar stream. Layers are
+// read directly, so no overlay mount (and no root) is needed.
+func (gt *GoTree) Export(refName string, w io.Writer) error {
+	ref, err := gt.getRef(refName)
+	if err != nil {
+		return fmt.Errorf("ref not found: %w", err)
+	}
+
+	objects, err := gt.objectInodes()
+	if err != nil {
+		return err
+	}
+	tb := newTarBuilder(w, objects)
+	err = walkMerged(gt.refStack(ref), func(rel, path string, info os.FileInfo, layer int) error {
+		return tb.add(rel, path, info, layer)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export %s: %w", refName, err)
+	}
+	return tb.Close()
+}
+
+// ExportFile exports a ref to a tar file, compressed according to its
+// extension (.tar, .tar.gz/.tgz or .tar.zst/.tzst). "-" writes an
+// uncompressed tar to stdout.
+func (gt *GoTree) ExportFile(refName, output string) error {
+	if output == "-" {
+		return gt.Export(refName, os.Stdout)
+	}
+
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create output: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	cw, err := compressWriter(f, output)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := gt.Export(refName, cw); err != nil {
+		cw.Close()
+		f.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to compress output: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	return os.Rename(tmp, output)
+}
+
+// compressWriter wraps w in the compressor matching the file name. zstd is
+// not in the standard library, so the zstd binary does that work.
+func compressWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewWriter(w), nil
+	case strings.HasSuffix(name, ".zst"), strings.HasSuffix(name, ".tzst"):
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to run zstd: %w", err)
+		}
+		return &cmdWriter{WriteCloser: stdin, cmd: cmd}, nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// cmdWriter feeds a filter command and waits for it on Close
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		c.cmd.Wait()
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// tarBuilder writes filesystem entries to a tar stream, keeping ownership,
+// modes, xattrs, device numbers and hardlinks
+type tarBuilder struct {
+	tw      *tar.Writer
+	links   map[tarInode]string
+	objects map[[2]uint64]bool // inodes of the object store, never hardlinks
+}
+
+// tarInode identifies a file for hardlink detection. Files of different
+// layers are never hardlinks of each other, even when they share an inode.
+type tarInode struct {
+	layer int
+	dev   uint64
+	ino   uint64
+}
+
+// newTarBuilder returns a tarBuilder writing to w. Files whose inode is in
+// objects are linked to the object store and archived as separate files.
+func newTarBuilder(w io.Writer, objects map[[2]uint64]bool) *tarBuilder {
+	return &tarBuilder{tw: tar.NewWriter(w), links: make(map[tarInode]string), objects: objects}
+}
+
+// add writes the entry rel, read from path, to the archive
+func (tb *tarBuilder) add(rel, path string, info os.FileInfo, layer int) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name = strings.TrimPrefix(rel+"/", "./")
+		if hdr.Name == "" {
+			hdr.Name = "./"
+		}
+	}
+	// Names would be looked up on this host, which says nothing about the
+	// tree being exported
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.Format = tar.FormatPAX
+
+	attrs, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		if isOverlayXattr(name) {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 &&
+		!tb.objects[[2]uint64{uint64(st.Dev), st.Ino}] {
+		key := tarInode{layer: layer, dev: uint64(st.Dev), ino: st.Ino}
+		if first, ok := tb.links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return tb.tw.WriteHeader(hdr)
+		}
+		tb.links[key] = rel
+	}
+
+	if err := tb.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(tb.tw, f); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", rel, err)
+	}
+	return nil
+}
+
+func (tb *tarBuilder) Close() error {
+	return tb.tw.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FsckProblem is one inconsistency found in the repository
+type FsckProblem struct {
+	Ref      string
+	Message  string
+	Repaired bool
+
+	repair func() error // nil when there is no safe fix
+}
+
+func (p FsckProblem) String() string {
+	s := fmt.Sprintf("%s: %s", p.Ref, p.Message)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Fsck checks that every ref parses and is named after its file, that its
+// layers exist, that its parent chain resolves without a cycle and that no
+// two refs share a layer. Tags are checked for missing layers. With
+// repair set, problems that have a safe fix are fixed in place.
+func (gt *GoTree) Fsck(repair bool) ([]FsckProblem, error) {
+	files, err := gt.readRefFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []FsckProblem
+	report := func(ref, format string, args ...interface{}) {
+		problems = append(problems, FsckProblem{Ref: ref, Message: fmt.Sprintf(format, args...)})
+	}
+	reportFixable := func(ref string, fix func() error, format string, args ...interface{}) {
+		problems = append(problems, FsckProblem{Ref: ref, Message: fmt.Sprintf(format, args...), repair: fix})
+	}
+
+	refs := make(map[string]*Ref)
+	for _, f := range files {
+		if f.Err != nil {
+			report(f.Name, "cannot parse %s: %v", f.Path, f.Err)
+			continue
+		}
+		refs[f.Name] = f.Ref
+	}
+
+	layerOwners := make(map[string][]string)
+	for _, name := range sortedRefNames(refs) {
+		ref := refs[name]
+
+		if ref.Name != name {
+			fixed := *ref
+			fixed.Name = name
+			reportFixable(name, func() error { return gt.saveRef(fixed, "fsck repair") },
+				"name field is '%s' but the file is %s.json", ref.Name, name)
+		}
+
+		if ref.LayerID == "" {
+			report(name, "has no layer ID")
+		} else if !gt.layerExists(ref.LayerID) {
+			layerPath := filepath.Join(gt.repoPath, "layers", ref.LayerID)
+			reportFixable(name, func() error { return os.MkdirAll(layerPath, 0755) },
+				"upper layer %s is missing", ref.LayerID)
+		}
+		for _, layerID := range ref.Layers {
+			if !gt.layerExists(layerID) {
+				report(name, "sealed layer %s is missing", layerID)
+			}
+		}
+		for _, layerID := range refLayerIDs(ref) {
+			if layerID != "" {
+				layerOwners[layerID] = append(layerOwners[layerID], name)
+			}
+		}
+
+		if ref.Head != "" {
+			if _, err := gt.getCommit(ref.Head); err != nil {
+				report(name, "head commit %s cannot be read: %v", ref.Head, err)
+			}
+		}
+
+		chain := []string{name}
+		seen := map[string]bool{name: true}
+		for current := ref; current.Parent != ""; {
+			chain = append(chain, current.Parent)
+			if seen[current.Parent] {
+				report(name, "parent chain loops: %s", strings.Join(chain, " -> "))
+				break
+			}
+			seen[current.Parent] = true
+
+			parent, ok := refs[current.Parent]
+			if !ok {
+				report(name, "parent chain is broken: %s does not exist", strings.Join(chain, " -> "))
+				break
+			}
+			current = parent
+		}
+		if ref.Tag != "" {
+			if _, err := gt.getTag(ref.Tag); err != nil {
+				report(name, "was created from tag '%s', which cannot be read: %v", ref.Tag, err)
+			}
+		}
+	}
+
+	tags, err := gt.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		for _, layerID := range tag.Layers {
+			if !gt.layerExists(layerID) {
+				report("tag "+tag.Name, "layer %s is missing", layerID)
+			}
+		}
+	}
+
+	layerIDs := make([]string, 0, len(layerOwners))
+	for layerID := range layerOwners {
+		layerIDs = append(layerIDs, layerID)
+	}
+	sort.Strings(layerIDs)
+	for _, layerID := range layerIDs {
+		if owners := layerOwners[layerID]; len(owners) > 1 {
+			report(owners[0], "layer %s is shared with %s", layerID, strings.Join(owners[1:], ", "))
+		}
+	}
+
+	if repair {
+		for i := range problems {
+			if problems[i].repair == nil {
+				continue
+			}
+			if err := problems[i].repair(); err != nil {
+				return problems, fmt.Errorf("failed to repair %s: %w", problems[i].Ref, err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+
+	return problems, nil
+}
+
+func (gt *GoTree) layerExists(layerID string) bool {
+	info, err := os.Stat(filepath.Join(gt.repoPath, "layers", layerID))
+	return err == nil && info.IsDir()
+}
+
+func sortedRefNames(refs map[string]*Ref) []string {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
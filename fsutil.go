@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ficlone is the FICLONE ioctl, which makes dst share src's extents
+const ficlone = 0x40049409
+
+// reflinkFile makes dst a copy-on-write clone of src. It fails with
+// EOPNOTSUPP or EXDEV when the filesystem cannot share extents.
+func reflinkFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if errno != 0 {
+		out.Close()
+		os.Remove(dst)
+		return errno
+	}
+	return out.Close()
+}
+
+// listXattrs returns the extended attributes of path without following
+// symlinks
+func listXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrNames(path)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if err != nil {
+			if err == syscall.ENODATA {
+				continue
+			}
+			return nil, err
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// xattrNames returns the sorted names of the extended attributes of path
+func xattrNames(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 256
+	for {
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR,
+			uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+		if errno == syscall.ERANGE {
+			size *= 4
+			continue
+		}
+		if errno == syscall.ENOTSUP {
+			return nil, nil
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+}
+
+// getXattr reads one extended attribute of path without following symlinks
+func getXattr(path, name string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 256
+	for {
+		buf := make([]byte, size)
+		sz, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR,
+			uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+		if errno == syscall.ERANGE {
+			size *= 4
+			continue
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		return buf[:sz], nil
+	}
+}
+
+// setXattr sets one extended attribute of path without following symlinks
+func setXattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)),
+		uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fileAttrs are the attributes gotree preserves when it copies or unpacks
+// a file
+type fileAttrs struct {
+	mode   os.FileMode
+	uid    int
+	gid    int
+	xattrs map[string][]byte
+	mtime  time.Time
+}
+
+// attrsFromInfo collects the attributes of the file at path
+func attrsFromInfo(path string, info os.FileInfo) (fileAttrs, error) {
+	a := fileAttrs{mode: info.Mode(), mtime: info.ModTime()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		a.uid, a.gid = int(st.Uid), int(st.Gid)
+	}
+	xattrs, err := listXattrs(path)
+	if err != nil {
+		return a, err
+	}
+	a.xattrs = xattrs
+	return a, nil
+}
+
+// apply sets ownership, permissions, xattrs and mtime on path. Ownership
+// goes first because chown clears the setuid and setgid bits.
+func (a fileAttrs) apply(path string) error {
+	if err := os.Lchown(path, a.uid, a.gid); err != nil {
+		return err
+	}
+	symlink := a.mode&os.ModeSymlink != 0
+	if !symlink {
+		if err := os.Chmod(path, a.mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	for name, value := range a.xattrs {
+		if err := setXattr(path, name, value); err != nil {
+			return fmt.Errorf("failed to set xattr %s on %s: %w", name, path, err)
+		}
+	}
+	return lutimes(path, a.mtime)
+}
+
+// lutimes sets the access and modification time of path without following
+// symlinks
+func lutimes(path string, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := []syscall.Timespec{
+		syscall.NsecToTimespec(mtime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	const atSymlinkNofollow = 0x100
+	dirfd := -100 // AT_FDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd),
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// mkdev encodes a device number the way the kernel expects it in mknod
+func mkdev(major, minor int64) int {
+	return int((major&0xfff)<<8 | (major&^0xfff)<<32 | minor&0xff | (minor&^0xff)<<12)
+}
+
+// makeWhiteout creates an overlayfs whiteout at path
+func makeWhiteout(path string) error {
+	return syscall.Mknod(path, syscall.S_IFCHR, 0)
+}
+
+// removeXattr removes one extended attribute of path without following
+// symlinks
+func removeXattr(path, name string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_LREMOVEXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either
+// the old or the new content: the data goes to a temporary file in the
+// same directory, is synced, and is renamed over path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and removals in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeEmptyDirs removes dir and then its parents, stopping below root
+// or at the first directory that is not empty
+func removeEmptyDirs(dir, root string) {
+	for strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// GCOptions controls a garbage collection run
+type GCOptions struct {
+	DryRun bool // report what would be removed without removing it
+}
+
+// GCItem is one piece of garbage found by GC
+type GCItem struct {
+	Kind string // "layer", "work", "commit", "mount", "tmp" or "object"
+	Path string
+	Size int64
+}
+
+// GCReport lists what a garbage collection run removed (or would remove)
+type GCReport struct {
+	Items []GCItem
+}
+
+// Size returns the total size of all collected items
+func (r *GCReport) Size() int64 {
+	var total int64
+	for _, item := range r.Items {
+		total += item.Size
+	}
+	return total
+}
+
+// Count returns the number of collected items of the given kind
+func (r *GCReport) Count(kind string) int {
+	n := 0
+	for _, item := range r.Items {
+		if item.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// GC removes layers that no ref, reachable commit or reflog entry of the
+// last 30 days uses, work dirs whose layer is gone, commits none of those
+// can reach, mount records whose mount point is no longer mounted (unless
+// they hold uncommitted changes), scratch directories and objects no layer
+// links to
+func (gt *GoTree) GC(opts GCOptions) (*GCReport, error) {
+	report := &GCReport{}
+
+	liveLayers, liveCommits, err := gt.reachable()
+	if err != nil {
+		return nil, err
+	}
+
+	collect := func(kind, path string) error {
+		size, _ := dirSize(path)
+		report.Items = append(report.Items, GCItem{Kind: kind, Path: path, Size: size})
+		if opts.DryRun {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		return nil
+	}
+
+	layersDir := filepath.Join(gt.repoPath, "layers")
+	entries, err := os.ReadDir(layersDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layers directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || liveLayers[entry.Name()] {
+			continue
+		}
+		if err := collect("layer", filepath.Join(layersDir, entry.Name())); err != nil {
+			return report, err
+		}
+	}
+
+	workDir := filepath.Join(gt.repoPath, "work")
+	entries, err = os.ReadDir(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read work directory: %w", err)
+	}
+	for _, entry := range entries {
+		if liveLayers[entry.Name()] {
+			continue
+		}
+		if err := collect("work", filepath.Join(workDir, entry.Name())); err != nil {
+			return report, err
+		}
+	}
+
+	commitsDir := filepath.Join(gt.repoPath, "commits")
+	entries, err = os.ReadDir(commitsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commits directory: %w", err)
+	}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if liveCommits[id] {
+			continue
+		}
+		if err := collect("commit", filepath.Join(commitsDir, entry.Name())); err != nil {
+			return report, err
+		}
+	}
+
+	mountsDir := filepath.Join(gt.repoPath, "mounts")
+	entries, err = os.ReadDir(mountsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts directory: %w", err)
+	}
+	for _, entry := range entries {
+		mountFile := filepath.Join(mountsDir, entry.Name())
+		data, err := os.ReadFile(mountFile)
+		if err != nil {
+			continue
+		}
+		var rec mountRecord
+		if json.Unmarshal(data, &rec) == nil && rec.MountPoint != "" &&
+			(gt.isMounted(rec.MountPoint) || gt.mountRecordPending(&rec)) {
+			continue
+		}
+		if err := collect("mount", mountFile); err != nil {
+			return report, err
+		}
+	}
+
+	// Scratch dirs of ephemeral mounts whose record is gone
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount records: %w", err)
+	}
+	liveScratch := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Scratch != "" {
+			liveScratch[rec.Scratch] = true
+		}
+	}
+	scratchDir := filepath.Join(gt.repoPath, "scratch")
+	entries, err = os.ReadDir(scratchDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read scratch directory: %w", err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(scratchDir, entry.Name())
+		if liveScratch[dir] {
+			continue
+		}
+		if !opts.DryRun && gt.isMounted(dir) {
+			if err := syscall.Unmount(dir, 0); err != nil {
+				return report, fmt.Errorf("failed to unmount tmpfs %s: %w", dir, err)
+			}
+		}
+		if err := collect("tmp", dir); err != nil {
+			return report, err
+		}
+	}
+
+	// Leftovers of interrupted imports and other scratch work
+	tmpDir := filepath.Join(gt.repoPath, "tmp")
+	entries, err = os.ReadDir(tmpDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read tmp directory: %w", err)
+	}
+	for _, entry := range entries {
+		if err := collect("tmp", filepath.Join(tmpDir, entry.Name())); err != nil {
+			return report, err
+		}
+	}
+
+	// Reflinked objects never share an inode with a layer file, so there
+	// is no cheap way to tell whether they are still used
+	if gt.config.ObjectStore != "reflink" {
+		objectsDir := filepath.Join(gt.repoPath, "objects")
+		err = filepath.Walk(objectsDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				return nil
+			}
+			return collect("object", p)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// reachable returns the layers and commits that some ref still depends on
+func (gt *GoTree) reachable() (map[string]bool, map[string]bool, error) {
+	layers := make(map[string]bool)
+	commits := make(map[string]bool)
+
+	// Unlike ListRefs, refuse to guess when a ref cannot be read: its
+	// layers would otherwise look like garbage
+	files, err := gt.readRefFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	var refs []Ref
+	for _, f := range files {
+		if f.Err != nil {
+			return nil, nil, fmt.Errorf("ref %s is unreadable, refusing to collect garbage (run fsck): %w", f.Name, f.Err)
+		}
+		refs = append(refs, *f.Ref)
+	}
+
+	// Refs in the trash keep their history until the trash is emptied
+	trashed, err := gt.ListTrash()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range trashed {
+		refs = append(refs, *entry.Ref)
+	}
+
+	// Recent changes can be undone, which needs the layers and commits
+	// they replaced, such as an upper layer with uncommitted changes
+	recent, err := gt.recentReflogRefs(time.Now().Add(-reflogRetention))
+	if err != nil {
+		return nil, nil, fmt.Errorf("refusing to collect garbage: %w", err)
+	}
+	refs = append(refs, recent...)
+
+	// Tags are read-only refs of their own
+	tags, err := gt.ListTags()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, tag := range tags {
+		refs = append(refs, Ref{Name: tag.Name, Layers: tag.Layers, Head: tag.Commit})
+	}
+
+	// Workspaces hold changes that are not committed yet, mounted or not,
+	// and whatever a kept record mounts has to stay for mount --restore
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, rec := range records {
+		if !gt.isMounted(rec.MountPoint) && !gt.mountRecordPending(&rec) {
+			continue
+		}
+		if rec.Workspace != "" {
+			layers[rec.Workspace] = true
+		}
+		for _, layerID := range rec.Layers {
+			layers[layerID] = true
+		}
+	}
+
+	for _, ref := range refs {
+		for _, layerID := range refLayerIDs(&ref) {
+			layers[layerID] = true
+		}
+
+		for id := ref.Head; id != "" && !commits[id]; {
+			commits[id] = true
+			commit, err := gt.getCommit(id)
+			if err != nil {
+				break
+			}
+			layers[commit.LayerID] = true
+			for _, layerID := range commit.Lower {
+				layers[layerID] = true
+			}
+			id = commit.Parent
+		}
+	}
+
+	return layers, commits, nil
+}
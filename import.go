@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Import creates a new ref whose layer holds the directory tree or tarball
+// at source. With a parent, only the difference from the parent's merged
+// view is stored, using whiteouts for deleted paths.
+func (gt *GoTree) Import(name, source, parent string) error {
+	if err := gt.validateRefName(name); err != nil {
+		return err
+	}
+	if _, err := gt.getRef(name); err == nil {
+		return fmt.Errorf("ref '%s' already exists", name)
+	}
+
+	var parentRef *Ref
+	if parent != "" {
+		var err error
+		parentRef, err = gt.getRef(parent)
+		if err != nil {
+			return fmt.Errorf("parent ref not found: %w", err)
+		}
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("cannot read import source: %w", err)
+	}
+
+	staging, err := gt.tempDir("import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	tree := filepath.Join(staging, "tree")
+
+	if info.IsDir() {
+		if err := copyTree(source, tree, false, nil); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", source, err)
+		}
+	} else {
+		if err := os.Mkdir(tree, 0755); err != nil {
+			return err
+		}
+		if err := extractTarFile(source, tree); err != nil {
+			return fmt.Errorf("failed to unpack %s: %w", source, err)
+		}
+	}
+
+	layerID := gt.generateLayerID()
+	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+
+	if parentRef == nil {
+		if err := os.Rename(tree, layerPath); err != nil {
+			return fmt.Errorf("failed to create layer: %w", err)
+		}
+	} else {
+		lower, err := readMergedView(gt.refStack(parentRef))
+		if err != nil {
+			return fmt.Errorf("failed to read parent ref: %w", err)
+		}
+		if err := os.MkdirAll(layerPath, 0755); err != nil {
+			return fmt.Errorf("failed to create layer: %w", err)
+		}
+		if err := writeDelta(lower, tree, layerPath); err != nil {
+			os.RemoveAll(layerPath)
+			return fmt.Errorf("failed to write layer: %w", err)
+		}
+	}
+
+	metadata := make(map[string]string)
+	if parentRef != nil {
+		inheritMetadata(metadata, parentRef.Metadata)
+	}
+
+	ref := Ref{
+		Name:      name,
+		Parent:    parent,
+		LayerID:   layerID,
+		CreatedAt: time.Now(),
+		Metadata:  metadata,
+	}
+
+	if err := gt.saveRef(ref, "import "+source); err != nil {
+		os.RemoveAll(layerPath)
+		return err
+	}
+	return nil
+}
+
+// tempDir creates a scratch directory inside the repository, on the same
+// filesystem as the layers so its contents can be renamed into them
+func (gt *GoTree) tempDir(prefix string) (string, error) {
+	tmpRoot := filepath.Join(gt.repoPath, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(tmpRoot, prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return dir, nil
+}
+
+// extractTarFile unpacks a tarball, plain or compressed with gzip or zstd,
+// into dst
+func extractTarFile(source, dst string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompressReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return extractTar(r, dst)
+}
+
+// decompressReader detects gzip and zstd streams by their magic number
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = br
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to run zstd: %w", err)
+		}
+		return &cmdReader{ReadCloser: stdout, cmd: cmd}, nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// cmdReader reads the output of a filter command and waits for it on Close
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	return c.cmd.Wait()
+}
+
+// extractTar unpacks a tar stream into dst, keeping ownership, modes,
+// xattrs, device nodes and hardlinks. Entries may not escape dst.
+func extractTar(r io.Reader, dst string) error {
+	return extractTarWith(r, dst, nil)
+}
+
+// extractTarWith is extractTar with a hook that may rewrite or consume
+// each entry before it is written. The hook returns the path to write the
+// entry to, or "" when it handled the entry itself.
+func extractTarWith(r io.Reader, dst string, hook func(rel string, hdr *tar.Header) (string, error)) error {
+	tr := tar.NewReader(r)
+	var dirs []string
+	var dirTimes []time.Time
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		rel := cleanTarPath(hdr.Name)
+		if hook != nil {
+			rel, err = hook(rel, hdr)
+			if err != nil {
+				return err
+			}
+			if rel == "" {
+				continue
+			}
+		}
+
+		target, err := safeJoin(dst, rel)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		// Later entries replace earlier ones, except directories which merge
+		if existing, err := os.Lstat(target); err == nil && rel != "." {
+			if !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			mode |= os.ModeSymlink
+		case tar.TypeLink:
+			source, err := safeJoin(dst, cleanTarPath(hdr.Linkname))
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			continue // a hardlink shares the attributes of its target
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			devType := map[byte]uint32{
+				tar.TypeChar:  syscall.S_IFCHR,
+				tar.TypeBlock: syscall.S_IFBLK,
+				tar.TypeFifo:  syscall.S_IFIFO,
+			}[hdr.Typeflag]
+			if err := syscall.Mknod(target, devType|uint32(mode), mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+				return fmt.Errorf("failed to create device %s: %w", rel, err)
+			}
+		default:
+			continue // PAX global headers and the like carry no file
+		}
+
+		if hdr.Mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if hdr.Mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if hdr.Mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+		attrs := fileAttrs{mode: mode, uid: hdr.Uid, gid: hdr.Gid, mtime: hdr.ModTime}
+		for key, value := range hdr.PAXRecords {
+			if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+				if attrs.xattrs == nil {
+					attrs.xattrs = make(map[string][]byte)
+				}
+				attrs.xattrs[name] = []byte(value)
+			}
+		}
+		if err := attrs.apply(target); err != nil {
+			return fmt.Errorf("failed to set attributes of %s: %w", rel, err)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, target)
+			dirTimes = append(dirTimes, hdr.ModTime)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := lutimes(dirs[i], dirTimes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanTarPath turns an archive member name into a clean relative path;
+// leading slashes and ".." components cannot climb above the root
+func cleanTarPath(name string) string {
+	rel := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+// safeJoin joins rel to root, refusing to pass through symlinks that an
+// earlier archive entry may have planted
+func safeJoin(root, rel string) (string, error) {
+	if rel == "." {
+		return root, nil
+	}
+	p := root
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		p = filepath.Join(p, part)
+		if i == len(parts)-1 {
+			break
+		}
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %q passes through a symlink", rel)
+		}
+	}
+	return filepath.Join(root, rel), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LineageNode is a ref in the parent/child tree shown by the tree command
+type LineageNode struct {
+	Ref         *Ref
+	MountPoints []string
+	Size        int64  // size of the ref's own layers
+	Message     string // first line of the last commit message
+	Children    []*LineageNode
+}
+
+// Lineage returns the refs as a forest of parent/child trees, or only the
+// tree below root when it is set. Children are sorted by name. Refs whose
+// parent is missing, or whose parent chain loops, are shown as roots so
+// that nothing is hidden.
+func (gt *GoTree) Lineage(root string) ([]*LineageNode, error) {
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+
+	nodes := make(map[string]*LineageNode)
+	for i := range refs {
+		node, err := gt.lineageNode(&refs[i])
+		if err != nil {
+			return nil, err
+		}
+		nodes[refs[i].Name] = node
+	}
+
+	var roots []*LineageNode
+	attached := make(map[string]bool)
+	for _, ref := range refs {
+		if parent, ok := nodes[ref.Parent]; ok && ref.Parent != "" {
+			parent.Children = append(parent.Children, nodes[ref.Name])
+			continue
+		}
+		roots = append(roots, nodes[ref.Name])
+	}
+	for _, node := range roots {
+		markAttached(node, attached)
+	}
+	for _, ref := range refs {
+		if !attached[ref.Name] {
+			roots = append(roots, nodes[ref.Name])
+			markAttached(nodes[ref.Name], attached)
+		}
+	}
+
+	if root == "" {
+		return roots, nil
+	}
+	node, ok := nodes[root]
+	if !ok {
+		return nil, fmt.Errorf("ref '%s' not found", root)
+	}
+	return []*LineageNode{node}, nil
+}
+
+func markAttached(node *LineageNode, attached map[string]bool) {
+	if attached[node.Ref.Name] {
+		return
+	}
+	attached[node.Ref.Name] = true
+	for _, child := range node.Children {
+		markAttached(child, attached)
+	}
+}
+
+func (gt *GoTree) lineageNode(ref *Ref) (*LineageNode, error) {
+	mountPoints, err := gt.mountPointsForRef(ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	node := &LineageNode{Ref: ref, MountPoints: mountPoints}
+
+	for _, layerID := range refLayerIDs(ref) {
+		if size, err := dirSize(filepath.Join(gt.repoPath, "layers", layerID)); err == nil {
+			node.Size += size
+		}
+	}
+	if ref.Head != "" {
+		if commit, err := gt.getCommit(ref.Head); err == nil {
+			node.Message = strings.SplitN(commit.Message, "\n", 2)[0]
+		}
+	}
+	return node, nil
+}
+
+// printLineage draws the trees with box-drawing characters
+func printLineage(w io.Writer, roots []*LineageNode) {
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		fmt.Fprintln(w, lineageLabel(root))
+		printLineageChildren(w, root, "", seen)
+	}
+}
+
+func printLineageChildren(w io.Writer, node *LineageNode, indent string, seen map[string]bool) {
+	// A parent chain that loops would otherwise be drawn forever
+	if seen[node.Ref.Name] {
+		return
+	}
+	seen[node.Ref.Name] = true
+
+	for i, child := range node.Children {
+		branch, next := "├── ", "│   "
+		if i == len(node.Children)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Fprintf(w, "%s%s%s\n", indent, branch, lineageLabel(child))
+		printLineageChildren(w, child, indent+next, seen)
+	}
+}
+
+func lineageLabel(node *LineageNode) string {
+	label := node.Ref.Name
+	if node.Ref.Tag != "" {
+		label += fmt.Sprintf(" (tag: %s)", node.Ref.Tag)
+	}
+	if len(node.MountPoints) > 0 {
+		label += fmt.Sprintf(" [mounted: %s]", strings.Join(node.MountPoints, ", "))
+	}
+	label += " " + formatBytes(node.Size)
+	if node.Message != "" {
+		label += " - " + node.Message
+	} else if node.Ref.Head == "" {
+		label += " - (no commits)"
+	}
+	return label
+}
+
+// writeLineageDot writes the trees as a Graphviz digraph, with an edge
+// from every parent to its children. Mounted refs are drawn bold, and
+// tags that refs were created from get nodes of their own.
+func writeLineageDot(w io.Writer, roots []*LineageNode) {
+	fmt.Fprintln(w, "digraph gotree {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintln(w, "\tnode [shape=box, fontname=\"monospace\"];")
+
+	seen := make(map[string]bool)
+	tags := make(map[string]bool)
+	var walk func(node *LineageNode)
+	walk = func(node *LineageNode) {
+		if seen[node.Ref.Name] {
+			return
+		}
+		seen[node.Ref.Name] = true
+
+		label := node.Ref.Name + "\n" + formatBytes(node.Size)
+		if node.Message != "" {
+			label += "\n" + node.Message
+		}
+		style := ""
+		if len(node.MountPoints) > 0 {
+			label += "\nmounted: " + strings.Join(node.MountPoints, ", ")
+			style = ", style=bold"
+		}
+		fmt.Fprintf(w, "\t%s [label=%s%s];\n", strconv.Quote(node.Ref.Name), strconv.Quote(label), style)
+
+		if tag := node.Ref.Tag; tag != "" {
+			if !tags[tag] {
+				tags[tag] = true
+				fmt.Fprintf(w, "\t%s [label=%s, shape=note];\n", strconv.Quote("tag:"+tag), strconv.Quote(tag))
+			}
+			fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote("tag:"+tag), strconv.Quote(node.Ref.Name))
+		}
+		for _, child := range node.Children {
+			fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(node.Ref.Name), strconv.Quote(child.Ref.Name))
+			walk(child)
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+
+	fmt.Fprintln(w, "}")
+}
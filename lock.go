@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultLockTimeout is how long a command waits for a lock unless the
+// lock_timeout setting or GOTREE_LOCK_TIMEOUT says otherwise
+const defaultLockTimeout = 30 * time.Second
+
+// lockHolder is written into a lock file by whoever holds it exclusively
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	User    string    `json:"user"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+// fileLock is a held flock
+type fileLock struct {
+	f *os.File
+}
+
+// Unlock releases the lock
+func (l *fileLock) Unlock() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+}
+
+// repoLock locks the whole repository: shared for commands that read or
+// change single refs, exclusive for commands such as gc that touch
+// everything
+func (gt *GoTree) repoLock(exclusive bool) (*fileLock, error) {
+	return gt.lock(filepath.Join(gt.repoPath, "lock"), "repository", exclusive)
+}
+
+// refLock locks one ref exclusively for a change
+func (gt *GoTree) refLock(name string) (*fileLock, error) {
+	path := filepath.Join(gt.repoPath, "locks", filepath.FromSlash(name)+".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	return gt.lock(path, fmt.Sprintf("ref '%s'", name), true)
+}
+
+func (gt *GoTree) lock(path, what string, exclusive bool) (*fileLock, error) {
+	timeout, err := gt.lockTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", what, err)
+		}
+		if !time.Now().Before(deadline) {
+			holders := describeLockHolders(f)
+			f.Close()
+			return nil, fmt.Errorf("%s is locked by %s, gave up after %s", what, holders, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Only an exclusive holder can say who it is without clobbering
+	// another holder's note
+	if exclusive {
+		holder := lockHolder{
+			PID:     os.Getpid(),
+			User:    currentUser(),
+			Command: strings.Join(os.Args, " "),
+			Since:   time.Now(),
+		}
+		data, _ := json.Marshal(holder)
+		if err := f.Truncate(0); err == nil {
+			f.WriteAt(append(data, '\n'), 0)
+		}
+	}
+	return &fileLock{f: f}, nil
+}
+
+// lockTimeout reads GOTREE_LOCK_TIMEOUT, then the lock_timeout setting
+func (gt *GoTree) lockTimeout() (time.Duration, error) {
+	if value := os.Getenv("GOTREE_LOCK_TIMEOUT"); value != "" {
+		timeout, err := parseAge(value)
+		if err != nil {
+			return 0, fmt.Errorf("GOTREE_LOCK_TIMEOUT: %w", err)
+		}
+		return timeout, nil
+	}
+	if gt.config.LockTimeout != "" {
+		timeout, err := parseAge(gt.config.LockTimeout)
+		if err != nil {
+			return 0, fmt.Errorf("lock_timeout: %w", err)
+		}
+		return timeout, nil
+	}
+	return defaultLockTimeout, nil
+}
+
+// describeLockHolders names the processes holding a lock on f, from
+// /proc/locks and the note an exclusive holder leaves in the file
+func describeLockHolders(f *os.File) string {
+	var holder lockHolder
+	data := make([]byte, 4096)
+	n, _ := f.ReadAt(data, 0)
+	if json.Unmarshal(data[:n], &holder) != nil {
+		holder.PID = 0
+	}
+
+	var names []string
+	for _, pid := range lockHolderPIDs(f) {
+		if pid == holder.PID {
+			names = append(names, fmt.Sprintf("pid %d (%s: %s) since %s", pid, holder.User, holder.Command,
+				holder.Since.Format("2006-01-02 15:04:05")))
+			continue
+		}
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		command := strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		if err != nil || command == "" {
+			names = append(names, fmt.Sprintf("pid %d", pid))
+			continue
+		}
+		names = append(names, fmt.Sprintf("pid %d (%s)", pid, command))
+	}
+
+	if len(names) == 0 {
+		return "another process"
+	}
+	return strings.Join(names, ", ")
+}
+
+// lockHolderPIDs lists the processes holding a flock on the same file as
+// f, according to /proc/locks
+func lockHolderPIDs(f *os.File) []int {
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return nil
+	}
+	defer locks.Close()
+
+	// 1: FLOCK  ADVISORY  WRITE 1234 00:2d:56789 0 EOF
+	// Waiters are listed with "->" after the number and are skipped
+	var pids []int
+	scanner := bufio.NewScanner(locks)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" {
+			continue
+		}
+		id := strings.Split(fields[5], ":")
+		if len(id) != 3 {
+			continue
+		}
+		ino, err := strconv.ParseUint(id[2], 10, 64)
+		if err != nil || ino != st.Ino {
+			continue
+		}
+		major, err1 := strconv.ParseUint(id[0], 16, 32)
+		minor, err2 := strconv.ParseUint(id[1], 16, 32)
+		if err1 != nil || err2 != nil || mkdev(int64(major), int64(minor)) != int(st.Dev) {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[4]); err == nil && pid != os.Getpid() {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// commandLocks takes the locks a command needs before it runs: the
+// repository lock, shared unless the command works on the repository as
+// a whole, and exclusive locks on the refs it changes or builds on, if any
+func (gt *GoTree) commandLocks(command string, args []string) ([]*fileLock, error) {
+	positional := func(i int) string {
+		n := 0
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "-") {
+				continue
+			}
+			if n == i {
+				return arg
+			}
+			n++
+		}
+		return ""
+	}
+	value := func(flag string) string {
+		for i, arg := range args {
+			if arg == flag && i+1 < len(args) {
+				return args[i+1]
+			}
+			if v, ok := strings.CutPrefix(arg, flag+"="); ok {
+				return v
+			}
+		}
+		return ""
+	}
+	has := func(flag string) bool {
+		for _, arg := range args {
+			if arg == flag || strings.HasPrefix(arg, flag+"=") {
+				return true
+			}
+		}
+		return false
+	}
+
+	exclusive := false
+	var refs []string
+	switch command {
+	case "gc", "squash", "dedup", "restore", "rename":
+		exclusive = true
+	case "fsck":
+		exclusive = has("--repair")
+	case "config":
+		exclusive = len(args) > 1
+	case "trash":
+		exclusive = positional(0) == "empty"
+	case "tag":
+		exclusive = positional(0) != "list"
+	case "rebase":
+		exclusive = has("--onto")
+		refs = []string{positional(0)}
+	case "import":
+		// An OCI import creates a whole chain of refs
+		exclusive = has("--format")
+		refs = []string{positional(0)}
+	case "create":
+		// Holding the parent's lock keeps it from being deleted under the
+		// new child
+		refs = []string{positional(0), positional(1)}
+	case "delete", "rm", "undo", "merge":
+		refs = []string{positional(0)}
+	case "mount":
+		// Restoring mounts whatever was mounted, of any ref
+		exclusive = has("--restore")
+		refs = []string{positional(0)}
+	case "commit":
+		refs = []string{positional(0)}
+		if has("--workspace") {
+			// Committing a workspace changes the ref it is a workspace of
+			refs = nil
+			if rec, err := gt.readMountRecord(positional(0)); err == nil {
+				refs = []string{rec.Ref}
+			}
+		}
+	case "copy":
+		// The source is locked too, so its layers cannot change mid-copy
+		refs = []string{positional(0), positional(1)}
+	case "unmount":
+		refs = []string{value("--promote")}
+	case "metadata":
+		if sub := positional(0); sub == "set" || sub == "delete" {
+			refs = []string{positional(1)}
+		}
+	}
+
+	repo, err := gt.repoLock(exclusive)
+	if err != nil {
+		return nil, err
+	}
+	locks := []*fileLock{repo}
+	if exclusive {
+		return locks, nil
+	}
+	// Always in the same order, so that two commands cannot each hold a
+	// lock the other waits for
+	sort.Strings(refs)
+	for i, ref := range refs {
+		if ref == "" || (i > 0 && ref == refs[i-1]) || gt.validateRefName(ref) != nil {
+			continue
+		}
+		r, err := gt.refLock(ref)
+		if err != nil {
+			for _, l := range locks {
+				l.Unlock()
+			}
+			return nil, err
+		}
+		locks = append(locks, r)
+	}
+	return locks, nil
+}
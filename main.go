@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -15,7 +20,10 @@ import (
 type Ref struct {
 	Name      string            `json:"name"`
 	Parent    string            `json:"parent,omitempty"`
+	Tag       string            `json:"tag,omitempty"` // tag the ref was created from, instead of a parent ref
 	LayerID   string            `json:"layer_id"`
+	Layers    []string          `json:"layers,omitempty"` // sealed read-only layers, newest first
+	Head      string            `json:"head,omitempty"`   // ID of the latest commit
 	CreatedAt time.Time         `json:"created_at"`
 	Metadata  map[string]string `json:"metadata,omitempty"`
 }
@@ -23,6 +31,7 @@ type Ref struct {
 // GoTree manages the repository
 type GoTree struct {
 	repoPath string
+	config   Config
 }
 
 // NewGoTree creates a new GoTree instance
@@ -35,6 +44,13 @@ func NewGoTree(repoPath string) (*GoTree, error) {
 		filepath.Join(repoPath, "layers"),
 		filepath.Join(repoPath, "work"),
 		filepath.Join(repoPath, "mounts"),
+		filepath.Join(repoPath, "commits"),
+		filepath.Join(repoPath, "objects"),
+		filepath.Join(repoPath, "reflog"),
+		filepath.Join(repoPath, "trash"),
+		filepath.Join(repoPath, "txn"),
+		filepath.Join(repoPath, "tags"),
+		filepath.Join(repoPath, "scratch"),
 	}
 
 	for _, dir := range dirs {
@@ -43,100 +59,201 @@ func NewGoTree(repoPath string) (*GoTree, error) {
 		}
 	}
 
+	if err := gt.loadConfig(); err != nil {
+		return nil, err
+	}
+
 	return gt, nil
 }
 
 // ListRefs lists all available refs/images
 func (gt *GoTree) ListRefs() ([]Ref, error) {
-	refsDir := filepath.Join(gt.repoPath, "refs")
-	entries, err := os.ReadDir(refsDir)
+	files, err := gt.readRefFiles()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read refs directory: %w", err)
+		return nil, err
 	}
 
 	var refs []Ref
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
-			continue
-		}
-
-		data, err := os.ReadFile(filepath.Join(refsDir, entry.Name()))
-		if err != nil {
-			continue
-		}
-
-		var ref Ref
-		if err := json.Unmarshal(data, &ref); err != nil {
+	for _, f := range files {
+		if f.Err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping unreadable ref %s: %v (run fsck)\n", f.Name, f.Err)
 			continue
 		}
-		refs = append(refs, ref)
+		refs = append(refs, *f.Ref)
 	}
 
 	return refs, nil
 }
 
-// CreateEmptyRef creates a new empty ref/image
-func (gt *GoTree) CreateEmptyRef(name string) error {
-	if err := gt.validateRefName(name); err != nil {
-		return err
-	}
+// refFile is one file under refs/, parsed or not
+type refFile struct {
+	Name string // ref name derived from the file name
+	Path string
+	Ref  *Ref
+	Err  error
+}
 
-	layerID := gt.generateLayerID()
-	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+// readRefFiles reads every ref file, including those in namespace
+// directories, keeping the ones that fail to parse
+func (gt *GoTree) readRefFiles() ([]refFile, error) {
+	names, err := jsonNamesUnder(filepath.Join(gt.repoPath, "refs"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read refs directory: %w", err)
+	}
 
-	if err := os.MkdirAll(layerPath, 0755); err != nil {
-		return fmt.Errorf("failed to create layer: %w", err)
+	var files []refFile
+	for _, name := range names {
+		f := refFile{
+			Name: name,
+			Path: gt.refPath(name),
+		}
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			f.Err = err
+		} else {
+			var ref Ref
+			if err := json.Unmarshal(data, &ref); err != nil {
+				f.Err = err
+			} else {
+				f.Ref = &ref
+			}
+		}
+		files = append(files, f)
 	}
 
+	return files, nil
+}
+
+// jsonNamesUnder returns the names of the .json files below dir, in
+// order. Subdirectories are namespaces: refs/team/alice.json is
+// "team/alice".
+func jsonNamesUnder(dir string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Names never start with a dot; temporary files do
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(strings.TrimSuffix(rel, ".json")))
+		return nil
+	})
+	return names, err
+}
+
+// CreateEmptyRef creates a new empty ref/image
+func (gt *GoTree) CreateEmptyRef(name string) error {
 	ref := Ref{
 		Name:      name,
-		LayerID:   layerID,
 		CreatedAt: time.Now(),
 		Metadata:  make(map[string]string),
 	}
 
-	return gt.saveRef(ref)
+	return gt.createRef(ref, "create")
 }
 
-// CreateRefFromParent creates a new ref/image from a parent ref
+// CreateRefFromParent creates a new ref/image from a parent ref, or from
+// a tag when no ref has that name
 func (gt *GoTree) CreateRefFromParent(name, parent string) error {
-	if err := gt.validateRefName(name); err != nil {
-		return err
-	}
-
 	parentRef, err := gt.getRef(parent)
 	if err != nil {
+		if tag, tagErr := gt.getTag(parent); tagErr == nil {
+			return gt.createRefFromTag(name, tag)
+		}
 		return fmt.Errorf("parent ref not found: %w", err)
 	}
 
-	layerID := gt.generateLayerID()
-	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+	// Copy parent metadata
+	metadata := make(map[string]string)
+	inheritMetadata(metadata, parentRef.Metadata)
 
-	if err := os.MkdirAll(layerPath, 0755); err != nil {
-		return fmt.Errorf("failed to create layer: %w", err)
+	ref := Ref{
+		Name:      name,
+		Parent:    parent,
+		CreatedAt: time.Now(),
+		Metadata:  metadata,
 	}
 
-	// Copy parent metadata
+	return gt.createRef(ref, "create from "+parent)
+}
+
+// createRefFromTag creates a new ref on top of the layers of a tag, with
+// the metadata of the commit the tag points at
+func (gt *GoTree) createRefFromTag(name string, tag *Tag) error {
 	metadata := make(map[string]string)
-	for k, v := range parentRef.Metadata {
-		metadata[k] = v
+	if commit, err := gt.getCommit(tag.Commit); err == nil {
+		inheritMetadata(metadata, commit.Metadata)
 	}
 
 	ref := Ref{
 		Name:      name,
-		Parent:    parent,
-		LayerID:   layerID,
+		Tag:       tag.Name,
 		CreatedAt: time.Now(),
 		Metadata:  metadata,
 	}
 
-	return gt.saveRef(ref)
+	return gt.createRef(ref, "create from tag "+tag.Name)
+}
+
+// createRef gives ref a new empty upper layer and saves it, as one
+// transaction
+func (gt *GoTree) createRef(ref Ref, op string) error {
+	if err := gt.validateRefName(ref.Name); err != nil {
+		return err
+	}
+	if _, err := gt.getRef(ref.Name); err == nil {
+		return fmt.Errorf("ref '%s' already exists", ref.Name)
+	}
+
+	t, err := gt.beginTxn(op + " " + ref.Name)
+	if err != nil {
+		return err
+	}
+
+	ref.LayerID = gt.generateLayerID()
+	layerPath := filepath.Join(gt.repoPath, "layers", ref.LayerID)
+	if err := t.creating(layerPath); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := os.MkdirAll(layerPath, 0755); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+
+	if err := t.changingRef(ref.Name); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := gt.saveRef(ref, op); err != nil {
+		t.rollback()
+		return err
+	}
+
+	t.done()
+	return nil
 }
 
-// Mount mounts a ref to a folder for read/write access
+// Mount mounts a ref to a folder for read/write access. A tag of that
+// name is mounted read-only instead.
 func (gt *GoTree) Mount(refName, mountPoint string) error {
 	ref, err := gt.getRef(refName)
 	if err != nil {
+		if _, tagErr := gt.getTag(refName); tagErr == nil {
+			return gt.MountReadOnly(refName, mountPoint)
+		}
 		return fmt.Errorf("ref not found: %w", err)
 	}
 
@@ -149,6 +266,44 @@ func (gt *GoTree) Mount(refName, mountPoint string) error {
 		return fmt.Errorf("mount point already in use")
 	}
 
+	// Overlayfs does not support two mounts sharing an upper dir
+	mountPoints, err := gt.writableMountPoints(refName)
+	if err != nil {
+		return err
+	}
+	for _, mp := range mountPoints {
+		if gt.isMounted(mp) {
+			return fmt.Errorf("ref '%s' is already mounted writable on %s; unmount it first and use --workspace for several writable mounts", refName, mp)
+		}
+	}
+	readers, err := gt.mountsOnUpper(ref)
+	if err != nil {
+		return err
+	}
+	if len(readers) > 0 {
+		return fmt.Errorf("ref '%s' is mounted on %s on top of its upper layer, which must not change under them; unmount them first", refName, strings.Join(readers, ", "))
+	}
+
+	absPath, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	if err := gt.mountOverlay(ref, mountPoint); err != nil {
+		return err
+	}
+
+	// Save mount info, the bind mount fallback included
+	if err := gt.saveMountRecord(&mountRecord{Ref: refName, MountPoint: absPath, Mode: "rw"}); err != nil {
+		syscall.Unmount(mountPoint, 0)
+		return err
+	}
+	return nil
+}
+
+// mountOverlay mounts the layer stack of ref on mountPoint, with the ref's
+// current layer as the writable upper dir
+func (gt *GoTree) mountOverlay(ref *Ref, mountPoint string) error {
 	// Build overlay layers
 	lowerDirs := gt.buildLowerDirs(ref)
 	upperDir := filepath.Join(gt.repoPath, "layers", ref.LayerID)
@@ -169,19 +324,15 @@ func (gt *GoTree) Mount(refName, mountPoint string) error {
 	}
 
 	if err := syscall.Mount("overlay", mountPoint, "overlay", 0, opts); err != nil {
+		if len(lowerDirs) > 0 {
+			// A bind mount of the upper dir alone would hide every sealed layer
+			return fmt.Errorf("failed to mount overlay: %w", err)
+		}
 		// Fallback: use bind mount for simple case
 		return syscall.Mount(upperDir, mountPoint, "", syscall.MS_BIND, "")
 	}
 
-	// Save mount info
-	mountInfo := map[string]string{
-		"ref":        refName,
-		"mountPoint": mountPoint,
-	}
-
-	data, _ := json.Marshal(mountInfo)
-	mountFile := filepath.Join(gt.repoPath, "mounts", filepath.Base(mountPoint)+".json")
-	return os.WriteFile(mountFile, data, 0644)
+	return nil
 }
 
 // Unmount unmounts a ref from a folder
@@ -195,6 +346,25 @@ func (gt *GoTree) UnmountForce(mountPoint string) error {
 }
 
 func (gt *GoTree) unmountWithOptions(mountPoint string, force bool) error {
+	if err := gt.checkWorkspaceCommitted(mountPoint); err != nil {
+		return err
+	}
+	// A record left behind by a reboot or a plain umount is cleared the
+	// same way
+	if !gt.isMounted(mountPoint) {
+		if _, err := gt.readMountRecord(mountPoint); err == nil {
+			return gt.forgetMount(mountPoint)
+		}
+	}
+	if err := gt.detachMount(mountPoint, force); err != nil {
+		return err
+	}
+	return gt.forgetMount(mountPoint)
+}
+
+// detachMount unmounts mountPoint, retrying while it is busy, and leaves
+// its record alone
+func (gt *GoTree) detachMount(mountPoint string, force bool) error {
 	if !gt.isMounted(mountPoint) {
 		return fmt.Errorf("mount point not mounted")
 	}
@@ -228,9 +398,6 @@ func (gt *GoTree) unmountWithOptions(mountPoint string, force bool) error {
 		
 		err := syscall.Unmount(mountPoint, 0)
 		if err == nil {
-			// Remove mount info
-			mountFile := filepath.Join(gt.repoPath, "mounts", filepath.Base(mountPoint)+".json")
-			os.Remove(mountFile)
 			return nil
 		}
 		
@@ -240,8 +407,6 @@ func (gt *GoTree) unmountWithOptions(mountPoint string, force bool) error {
 		if i == maxRetries-1 {
 			err = syscall.Unmount(mountPoint, syscall.MNT_DETACH)
 			if err == nil {
-				mountFile := filepath.Join(gt.repoPath, "mounts", filepath.Base(mountPoint)+".json")
-				os.Remove(mountFile)
 				return nil
 			}
 		}
@@ -272,15 +437,53 @@ func (gt *GoTree) killProcessesUsingMount(mountPoint string) {
 	}
 }
 
-// Commit "pushes" changes from a mounted ref back to the image
+// Commit seals the ref's current upper layer into a read-only layer and
+// starts a fresh upper layer on top of it. Mounts of the ref are moved onto
+// the new upper layer; if one of them is busy the commit is refused.
 func (gt *GoTree) Commit(refName, message string) error {
 	ref, err := gt.getRef(refName)
 	if err != nil {
 		return fmt.Errorf("ref not found: %w", err)
 	}
 
-	// Update timestamp and commit message metadata
-	ref.CreatedAt = time.Now()
+	mountPoints, err := gt.writableMountPoints(refName)
+	if err != nil {
+		return err
+	}
+
+	// Overlayfs cannot swap the upper dir of a live mount, so every writable
+	// mount of the ref is taken down while the layer is sealed and brought
+	// back up afterwards. Mounts with the upper layer as a lower dir are
+	// never up next to a writable one, so nothing else has to move.
+	syscall.Sync()
+	var unmounted []string
+	for _, mp := range mountPoints {
+		if !gt.isMounted(mp) {
+			continue
+		}
+		if err := syscall.Unmount(mp, 0); err != nil {
+			gt.remount(ref, unmounted)
+			return fmt.Errorf("cannot commit '%s': mount point %s is busy (%v), close files using it or unmount it first", refName, mp, err)
+		}
+		unmounted = append(unmounted, mp)
+	}
+
+	oldLayerID := ref.LayerID
+	oldLayerPath := filepath.Join(gt.repoPath, "layers", oldLayerID)
+	layerID := gt.generateLayerID()
+	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+
+	if err := os.MkdirAll(layerPath, 0755); err != nil {
+		gt.remount(ref, unmounted)
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+	// The root of the merged tree takes its attributes from the upper dir
+	if err := copyDirAttrs(oldLayerPath, layerPath); err != nil {
+		os.RemoveAll(layerPath)
+		gt.remount(ref, unmounted)
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+
 	if ref.Metadata == nil {
 		ref.Metadata = make(map[string]string)
 	}
@@ -288,7 +491,57 @@ func (gt *GoTree) Commit(refName, message string) error {
 		ref.Metadata["commit.message"] = message
 	}
 
-	return gt.saveRef(*ref)
+	now := time.Now()
+	commit, err := gt.newCommit(ref, ref.LayerID, gt.lowerLayerIDs(ref), message, now)
+	if err != nil {
+		os.RemoveAll(layerPath)
+		gt.remount(ref, unmounted)
+		return err
+	}
+
+	sealed := *ref
+	sealed.Layers = append([]string{oldLayerID}, ref.Layers...)
+	sealed.LayerID = layerID
+	sealed.Head = commit.ID
+	sealed.CreatedAt = now
+
+	op := "commit"
+	if message != "" {
+		op += ": " + firstLine(message)
+	}
+	if err := gt.saveRef(sealed, op); err != nil {
+		os.RemoveAll(layerPath)
+		gt.remount(ref, unmounted)
+		return fmt.Errorf("failed to save ref: %w", err)
+	}
+
+	// The sealed layer is never an upper dir again, so its work dir can go
+	_ = os.RemoveAll(filepath.Join(gt.repoPath, "work", oldLayerID))
+
+	if err := gt.remount(&sealed, unmounted); err != nil {
+		return fmt.Errorf("committed, but %w", err)
+	}
+
+	if gt.config.ObjectStore != "" {
+		if _, err := gt.dedupLayer(oldLayerID, gt.config.ObjectStore); err != nil {
+			return fmt.Errorf("committed, but failed to deduplicate layer: %w", err)
+		}
+	}
+	return nil
+}
+
+// remount mounts ref again on each of the given mount points
+func (gt *GoTree) remount(ref *Ref, mountPoints []string) error {
+	var failed []string
+	for _, mp := range mountPoints {
+		if err := gt.mountOverlay(ref, mp); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", mp, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remount %s", strings.Join(failed, ", "))
+	}
+	return nil
 }
 
 // SetMetadata sets a metadata key-value pair for a ref
@@ -303,7 +556,7 @@ func (gt *GoTree) SetMetadata(refName, key, value string) error {
 	}
 
 	ref.Metadata[key] = value
-	return gt.saveRef(*ref)
+	return gt.saveRef(*ref, "metadata set "+key)
 }
 
 // GetMetadata gets a metadata value for a ref
@@ -351,7 +604,7 @@ func (gt *GoTree) DeleteMetadata(refName, key string) error {
 	}
 
 	delete(ref.Metadata, key)
-	return gt.saveRef(*ref)
+	return gt.saveRef(*ref, "metadata delete "+key)
 }
 
 // HasChildren returns true if any ref has this one as parent
@@ -368,43 +621,74 @@ func (gt *GoTree) HasChildren(refName string) (bool, error) {
 	return false, nil
 }
 
+// descendants returns the names of every ref built on top of refName,
+// directly or through other refs
+func (gt *GoTree) descendants(refName string) ([]string, error) {
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := map[string]bool{refName: true}
+	queue := []string{refName}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, r := range refs {
+			if r.Parent == current && !seen[r.Name] {
+				seen[r.Name] = true
+				names = append(names, r.Name)
+				queue = append(queue, r.Name)
+			}
+		}
+	}
+	return names, nil
+}
+
 // IsMountedRef checks if the ref is currently mounted anywhere
 func (gt *GoTree) IsMountedRef(refName string) (bool, error) {
-	mountsDir := filepath.Join(gt.repoPath, "mounts")
-	entries, err := os.ReadDir(mountsDir)
+	mountPoints, err := gt.mountPointsForRef(refName)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
 		return false, err
 	}
+	return len(mountPoints) > 0, nil
+}
 
-	for _, entry := range entries {
-		if !strings.HasSuffix(entry.Name(), ".json") {
-			continue
-		}
-		data, err := os.ReadFile(filepath.Join(mountsDir, entry.Name()))
-		if err != nil {
-			continue
-		}
-		var info map[string]string
-		if json.Unmarshal(data, &info) != nil {
-			continue
-		}
-		if info["ref"] == refName {
-			return true, nil
+// mountPointsForRef returns the recorded mount points of a ref, read-only
+// ones included
+func (gt *GoTree) mountPointsForRef(refName string) ([]string, error) {
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	var mountPoints []string
+	for _, rec := range records {
+		if rec.Ref == refName {
+			mountPoints = append(mountPoints, rec.MountPoint)
 		}
 	}
-	return false, nil
+	return mountPoints, nil
 }
 
-// DeleteRef removes a ref and its layer directory (with safety checks)
+// DeleteRef moves a ref and its layers to the trash (with safety checks),
+// from where it can be restored until the trash is emptied
 func (gt *GoTree) DeleteRef(name string, force bool) error {
 	ref, err := gt.getRef(name)
 	if err != nil {
 		return fmt.Errorf("ref not found: %w", err)
 	}
 
+	// Not even --force: the tags would lose their layers to the trash
+	tagged, err := gt.tagsUsingLayers(refLayerIDs(ref))
+	if err != nil {
+		return err
+	}
+	if len(tagged) > 0 {
+		return fmt.Errorf("cannot delete ref '%s': tagged by %s", name, strings.Join(tagged, ", "))
+	}
+
 	if !force {
 		hasChildren, err := gt.HasChildren(name)
 		if err != nil {
@@ -423,54 +707,148 @@ func (gt *GoTree) DeleteRef(name string, force bool) error {
 		}
 	}
 
-	// Delete ref metadata file
-	refPath := filepath.Join(gt.repoPath, "refs", name+".json")
-	if err := os.Remove(refPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove ref file: %w", err)
+	t, err := gt.beginTxn("delete " + name)
+	if err != nil {
+		return err
 	}
-
-	// Delete layer directory
-	layerPath := filepath.Join(gt.repoPath, "layers", ref.LayerID)
-	if err := os.RemoveAll(layerPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove layer directory: %w", err)
+	if _, err := gt.trashRef(t, ref); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := t.changingRef(name); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := gt.removeRef(name, "delete"); err != nil {
+		t.rollback()
+		return err
 	}
+	t.done()
 
-	// Clean up work dir (best effort)
-	workPath := filepath.Join(gt.repoPath, "work", ref.LayerID)
-	_ = os.RemoveAll(workPath)
+	// Clean up work dirs (best effort)
+	for _, layerID := range refLayerIDs(ref) {
+		workPath := filepath.Join(gt.repoPath, "work", layerID)
+		_ = os.RemoveAll(workPath)
+	}
 
 	return nil
 }
 
 // Helper methods
 
+// validateRefName checks a ref name. Slashes separate namespaces, which
+// are stored as directories, so each part must be a safe file name.
 func (gt *GoTree) validateRefName(name string) error {
 	if name == "" {
 		return fmt.Errorf("ref name cannot be empty")
 	}
-	if strings.ContainsAny(name, "/\\:*?\"<>|") {
+	if strings.ContainsAny(name, "\\:*?\"<>|@") {
 		return fmt.Errorf("ref name contains invalid characters")
 	}
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("ref name cannot contain '..'")
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch {
+		case part == "":
+			return fmt.Errorf("ref name cannot have empty parts")
+		case strings.HasPrefix(part, "."):
+			return fmt.Errorf("ref name parts cannot start with a dot")
+		// A namespace directory must not clash with a ref, reflog or lock file
+		case strings.HasSuffix(part, ".json") || strings.HasSuffix(part, ".jsonl") || strings.HasSuffix(part, ".lock"):
+			return fmt.Errorf("ref name parts cannot end in .json, .jsonl or .lock")
+		}
+	}
 	return nil
 }
 
+// matchRefName reports whether a ref name passes a list filter: a glob
+// such as 'team/*/feature-*', which may also match one of the name's
+// namespaces, or else a ref name or namespace, so that team/alice does
+// not also match team/alice2
+func matchRefName(pattern, name string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		if strings.HasSuffix(pattern, "/") {
+			return strings.HasPrefix(name, pattern)
+		}
+		return name == pattern || strings.HasPrefix(name, pattern+"/")
+	}
+	for prefix := name; ; {
+		if ok, _ := path.Match(pattern, prefix); ok {
+			return true
+		}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			return false
+		}
+		prefix = prefix[:i]
+	}
+}
+
+// refPath returns the file of a ref; namespaced names such as
+// team/alice/feature-x live in subdirectories of refs/
+func (gt *GoTree) refPath(name string) string {
+	return filepath.Join(gt.repoPath, "refs", filepath.FromSlash(name)+".json")
+}
+
+// generateLayerID returns a new layer ID. The random suffix keeps IDs
+// unique when several processes create layers at the same time.
 func (gt *GoTree) generateLayerID() string {
-	return fmt.Sprintf("layer_%d", time.Now().UnixNano())
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("layer_%d_%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
 }
 
-func (gt *GoTree) saveRef(ref Ref) error {
+// saveRef writes a ref file and records the change, described by op, in
+// the ref's reflog
+func (gt *GoTree) saveRef(ref Ref, op string) error {
 	data, err := json.MarshalIndent(ref, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal ref: %w", err)
 	}
 
-	refPath := filepath.Join(gt.repoPath, "refs", ref.Name+".json")
-	return os.WriteFile(refPath, data, 0644)
+	refPath := gt.refPath(ref.Name)
+	old, err := os.ReadFile(refPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read ref: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return fmt.Errorf("failed to create ref namespace: %w", err)
+	}
+	if err := writeFileAtomic(refPath, data, 0644); err != nil {
+		return err
+	}
+	if err := gt.appendReflog(ref.Name, op, old, data); err != nil {
+		return fmt.Errorf("ref saved, but %w", err)
+	}
+	return nil
+}
+
+// removeRef removes a ref file, keeping its old content in the reflog
+func (gt *GoTree) removeRef(name, op string) error {
+	refPath := gt.refPath(name)
+	old, err := os.ReadFile(refPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read ref: %w", err)
+	}
+	if err := os.Remove(refPath); err != nil {
+		return fmt.Errorf("failed to remove ref file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(refPath)); err != nil {
+		return fmt.Errorf("failed to remove ref file: %w", err)
+	}
+	removeEmptyDirs(filepath.Dir(refPath), filepath.Join(gt.repoPath, "refs"))
+	if err := gt.appendReflog(name, op, old, nil); err != nil {
+		return fmt.Errorf("ref removed, but %w", err)
+	}
+	return nil
 }
 
 func (gt *GoTree) getRef(name string) (*Ref, error) {
-	refPath := filepath.Join(gt.repoPath, "refs", name+".json")
-	data, err := os.ReadFile(refPath)
+	data, err := os.ReadFile(gt.refPath(name))
 	if err != nil {
 		return nil, err
 	}
@@ -484,32 +862,65 @@ func (gt *GoTree) getRef(name string) (*Ref, error) {
 }
 
 func (gt *GoTree) buildLowerDirs(ref *Ref) []string {
-	var dirs []string
+	return gt.layerPaths(gt.lowerLayerIDs(ref))
+}
+
+// lowerLayerIDs returns the IDs of the layers below the ref's upper layer,
+// topmost first
+func (gt *GoTree) lowerLayerIDs(ref *Ref) []string {
+	layerIDs := append([]string(nil), ref.Layers...)
 
 	current := ref
-	for current.Parent != "" {
+	seen := map[string]bool{ref.Name: true} // a looping chain is reported by fsck
+	for current.Parent != "" && !seen[current.Parent] {
+		seen[current.Parent] = true
 		parent, err := gt.getRef(current.Parent)
 		if err != nil {
 			break
 		}
-		dirs = append(dirs, filepath.Join(gt.repoPath, "layers", parent.LayerID))
+		layerIDs = append(layerIDs, refLayerIDs(parent)...)
 		current = parent
 	}
+	if current.Tag != "" {
+		if tag, err := gt.getTag(current.Tag); err == nil {
+			layerIDs = append(layerIDs, tag.Layers...)
+		}
+	}
 
-	return dirs
+	return layerIDs
 }
 
-func (gt *GoTree) isMounted(mountPoint string) bool {
-	data, err := os.ReadFile("/proc/mounts")
+// refLayerIDs returns the upper layer of a ref followed by its sealed layers
+func refLayerIDs(ref *Ref) []string {
+	return append([]string{ref.LayerID}, ref.Layers...)
+}
+
+// copyDirAttrs copies the mode and ownership of directory src to dst
+func copyDirAttrs(src, dst string) error {
+	info, err := os.Stat(src)
 	if err != nil {
-		return false
+		return err
 	}
-
-	absPath, _ := filepath.Abs(mountPoint)
-	return strings.Contains(string(data), absPath)
+	if err := os.Chmod(dst, info.Mode().Perm()|info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return os.Lchown(dst, int(st.Uid), int(st.Gid))
+	}
+	return nil
 }
 
-// dirSize returns the apparent size (sum of file sizes) of all regular files in the directory tree
+// isMounted reports whether mountPoint itself is a mount point, not just
+// a path that shares a prefix with one
+func (gt *GoTree) isMounted(mountPoint string) bool {
+	mounted, err := mountedPaths()
+	if err != nil {
+		return false
+	}
+	return mounted[canonicalPath(mountPoint)]
+}
+
+// dirSize returns the apparent size (sum of file sizes) of all regular files in the directory tree
 func dirSize(path string) (int64, error) {
 	var total int64
 	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
@@ -544,6 +955,17 @@ func formatBytes(b int64) string {
 // CLI interface
 
 func main() {
+	// mount(8) runs mount.gotree for fstab entries and mount units of
+	// type gotree
+	if filepath.Base(os.Args[0]) == "mount.gotree" {
+		args, err := mountHelperArgs(os.Args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Args = append(os.Args[:1], args...)
+	}
+
 	if len(os.Args) < 3 {
 		printUsage()
 		os.Exit(1)
@@ -558,17 +980,43 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Undo whatever a crashed command left half done
+	if err := gt.recoverTxns(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Locks are released when the process exits, os.Exit included
+	if _, err := gt.commandLocks(command, os.Args[3:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	switch command {
 	case "list":
+		pattern := ""
+		if len(os.Args) > 3 {
+			pattern = os.Args[3]
+			if _, err := path.Match(pattern, ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid pattern %s: %v\n", pattern, err)
+				os.Exit(1)
+			}
+		}
+
 		refs, err := gt.ListRefs()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error listing refs: %v\n", err)
 			os.Exit(1)
 		}
 		for _, ref := range refs {
+			if pattern != "" && !matchRefName(pattern, ref.Name) {
+				continue
+			}
 			parent := ""
 			if ref.Parent != "" {
 				parent = fmt.Sprintf(" (parent: %s)", ref.Parent)
+			} else if ref.Tag != "" {
+				parent = fmt.Sprintf(" (tag: %s)", ref.Tag)
 			}
 			metadata := ""
 			if len(ref.Metadata) > 0 {
@@ -586,6 +1034,28 @@ func main() {
 			fmt.Printf("%s%s%s - %s\n", ref.Name, parent, metadata, ref.CreatedAt.Format(time.RFC3339))
 		}
 
+	case "tree":
+		args, flags, err := parseArgs(os.Args[3:], "--dot")
+		if err != nil || len(args) > 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> tree [root] [--dot]\n", os.Args[0])
+			os.Exit(1)
+		}
+		root := ""
+		if len(args) == 1 {
+			root = args[0]
+		}
+
+		roots, err := gt.Lineage(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error building tree: %v\n", err)
+			os.Exit(1)
+		}
+		if hasFlag(flags, "--dot") {
+			writeLineageDot(os.Stdout, roots)
+		} else {
+			printLineage(os.Stdout, roots)
+		}
+
 	case "create":
 		if len(os.Args) < 4 {
 			fmt.Fprintf(os.Stderr, "Usage: %s <repo> create <name> [parent]\n", os.Args[0])
@@ -608,12 +1078,63 @@ func main() {
 		fmt.Printf("Created ref: %s\n", name)
 
 	case "mount":
-		if len(os.Args) < 5 {
-			fmt.Fprintf(os.Stderr, "Usage: %s <repo> mount <ref> <mountpoint>\n", os.Args[0])
+		args, flags, err := parseArgs(os.Args[3:], "--read-only", "--ephemeral", "--tmpfs", "--workspace", "--restore")
+		badFlags := checkMountFlags(func(flag string) bool { return hasFlag(flags, flag) }) != nil
+		if !badFlags && hasFlag(flags, "--restore") && len(args) == 0 {
+			results, err := gt.RestoreMounts()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error restoring mounts: %v\n", err)
+				os.Exit(1)
+			}
+			if len(results) == 0 {
+				fmt.Println("Nothing to restore")
+			}
+			for _, r := range results {
+				if r.Kept {
+					fmt.Printf("Could not restore %s (%s): %v\n", r.MountPoint, r.Mode, r.Err)
+					fmt.Printf("  its changes are kept; unmount it with --promote <new-ref> or --discard\n")
+				} else if r.Err != nil {
+					fmt.Printf("Cleared record of %s (%s): %v\n", r.MountPoint, r.Mode, r.Err)
+				} else {
+					fmt.Printf("Restored %s (%s)\n", r.MountPoint, r.Mode)
+				}
+			}
+			break
+		}
+		if err != nil || badFlags || len(args) != 2 || hasFlag(flags, "--restore") {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> mount [--read-only|--ephemeral [--tmpfs]|--workspace] <ref[@commit]|tag> <mountpoint>\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s <repo> mount --restore\n", os.Args[0])
 			os.Exit(1)
 		}
-		refName := os.Args[3]
-		mountPoint := os.Args[4]
+		refName := args[0]
+		mountPoint := args[1]
+
+		if hasFlag(flags, "--workspace") {
+			if err := gt.MountWorkspace(refName, mountPoint); err != nil {
+				fmt.Fprintf(os.Stderr, "Error mounting: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Mounted a workspace of %s to %s\n", refName, mountPoint)
+			break
+		}
+
+		if hasFlag(flags, "--ephemeral") {
+			if err := gt.MountEphemeral(refName, mountPoint, hasFlag(flags, "--tmpfs")); err != nil {
+				fmt.Fprintf(os.Stderr, "Error mounting: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Mounted %s to %s, changes are discarded on unmount\n", refName, mountPoint)
+			break
+		}
+
+		if hasFlag(flags, "--read-only") {
+			if err := gt.MountReadOnly(refName, mountPoint); err != nil {
+				fmt.Fprintf(os.Stderr, "Error mounting: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Mounted %s read-only to %s\n", refName, mountPoint)
+			break
+		}
 
 		if err := gt.Mount(refName, mountPoint); err != nil {
 			fmt.Fprintf(os.Stderr, "Error mounting: %v\n", err)
@@ -622,18 +1143,19 @@ func main() {
 		fmt.Printf("Mounted %s to %s\n", refName, mountPoint)
 
 	case "unmount":
-		if len(os.Args) < 4 {
-			fmt.Fprintf(os.Stderr, "Usage: %s <repo> unmount <mountpoint> [--force]\n", os.Args[0])
+		args, flags, err := parseArgs(os.Args[3:], "--force", "--promote=", "--discard")
+		if err != nil || len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> unmount <mountpoint> [--force] [--promote <new-ref>|--discard]\n", os.Args[0])
 			os.Exit(1)
 		}
-		mountPoint := os.Args[3]
-		force := false
-		if len(os.Args) > 4 && os.Args[4] == "--force" {
-			force = true
-		}
-		
-		var err error
-		if force {
+		mountPoint := args[0]
+		force := hasFlag(flags, "--force")
+
+		if name, ok := flags["--promote"]; ok {
+			err = gt.PromoteMount(mountPoint, name, force)
+		} else if hasFlag(flags, "--discard") {
+			err = gt.DiscardWorkspace(mountPoint, force)
+		} else if force {
 			err = gt.UnmountForce(mountPoint)
 		} else {
 			err = gt.Unmount(mountPoint)
@@ -647,16 +1169,104 @@ func main() {
 			os.Exit(1)
 		}
 		fmt.Printf("Unmounted %s\n", mountPoint)
+		if name, ok := flags["--promote"]; ok {
+			fmt.Printf("Kept its changes as ref %s\n", name)
+		}
+
+	case "automount":
+		args, flags, err := parseArgs(os.Args[3:], "--fstab", "--systemd=")
+		dir, systemd := flags["--systemd"]
+		if err != nil || len(args) != 0 || hasFlag(flags, "--fstab") == systemd {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> automount --fstab|--systemd <dir>\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		mounts, err := gt.Automounts()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(mounts) == 0 {
+			fmt.Fprintln(os.Stderr, "No refs are marked for automount (metadata key 'automount')")
+			break
+		}
+		if !systemd {
+			if err := gt.writeFstab(os.Stdout, mounts); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			break
+		}
+
+		paths, err := gt.WriteMountUnits(dir, mounts)
+		for _, p := range paths {
+			fmt.Printf("Wrote %s\n", p)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Enable them with: systemctl daemon-reload && systemctl enable <unit>")
+
+	case "mounts":
+		entries, err := gt.ListMounts()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing mounts: %v\n", err)
+			os.Exit(1)
+		}
+		if len(entries) == 0 {
+			fmt.Println("Nothing is mounted")
+		}
+		var rows [][]string
+		width := [2]int{}
+		for _, e := range entries {
+			what := e.Ref
+			if e.Tag != "" {
+				what = "tag " + e.Tag
+			} else if e.Commit != "" {
+				what += fmt.Sprintf("@%.12s", e.Commit)
+			}
+			mode := e.Mode
+			if mode == "" {
+				mode = "rw"
+			}
+			// Records from before PIDs were kept have neither
+			created := "-"
+			if !e.Created.IsZero() {
+				created = fmt.Sprintf("pid %d, %s", e.PID, e.Created.Format("2006-01-02 15:04:05"))
+			}
+			if e.Stale {
+				created += "  (stale)"
+			}
+			rows = append(rows, []string{e.MountPoint, what, mode, created})
+			width[0] = max(width[0], len(e.MountPoint))
+			width[1] = max(width[1], len(what))
+		}
+		for _, row := range rows {
+			fmt.Printf("%-*s  %-*s  %-9s  %s\n", width[0], row[0], width[1], row[1], row[2], row[3])
+		}
 
 	case "commit":
-		if len(os.Args) < 4 {
+		args, flags, err := parseArgs(os.Args[3:], "--workspace")
+		if err != nil || len(args) < 1 || len(args) > 2 {
 			fmt.Fprintf(os.Stderr, "Usage: %s <repo> commit <ref> [message]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s <repo> commit --workspace <mountpoint> [message]\n", os.Args[0])
 			os.Exit(1)
 		}
-		refName := os.Args[3]
+		refName := args[0]
 		message := ""
-		if len(os.Args) > 4 {
-			message = os.Args[4]
+		if len(args) > 1 {
+			message = args[1]
+		}
+
+		if hasFlag(flags, "--workspace") {
+			commit, err := gt.CommitWorkspace(refName, message)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error committing: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Committed workspace %s to %s as %s\n", refName, commit.Ref, commit.ShortID())
+			break
 		}
 
 		if err := gt.Commit(refName, message); err != nil {
@@ -665,6 +1275,269 @@ func main() {
 		}
 		fmt.Printf("Committed changes to %s\n", refName)
 
+	case "log":
+		if len(os.Args) < 4 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> log <ref> [--oneline|--json]\n", os.Args[0])
+			os.Exit(1)
+		}
+		refName := os.Args[3]
+		format := ""
+		if len(os.Args) > 4 {
+			format = os.Args[4]
+		}
+
+		commits, err := gt.Log(refName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading log: %v\n", err)
+			os.Exit(1)
+		}
+
+		switch format {
+		case "":
+			for i, c := range commits {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("commit %s\n", c.ID)
+				fmt.Printf("Author: %s\n", c.Author)
+				fmt.Printf("Date:   %s\n", c.Timestamp.Format(time.RFC1123Z))
+				fmt.Printf("Layer:  %s\n", c.LayerID)
+				if c.Message != "" {
+					fmt.Printf("\n    %s\n", strings.ReplaceAll(c.Message, "\n", "\n    "))
+				}
+			}
+		case "--oneline":
+			for _, c := range commits {
+				fmt.Printf("%s %s\n", c.ShortID(), firstLine(c.Message))
+			}
+		case "--json":
+			if commits == nil {
+				commits = []Commit{}
+			}
+			data, _ := json.MarshalIndent(commits, "", "  ")
+			fmt.Println(string(data))
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown log option: %s\n", format)
+			os.Exit(1)
+		}
+
+	case "diff":
+		args, flags, err := parseArgs(os.Args[3:], "--stat", "--name-only", "--json")
+		if err != nil || len(args) < 1 || len(args) > 2 || len(flags) > 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> diff <refA> [refB] [--stat|--name-only|--json]\n", os.Args[0])
+			os.Exit(1)
+		}
+		refB := ""
+		if len(args) == 2 {
+			refB = args[1]
+		}
+
+		entries, err := gt.Diff(args[0], refB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error computing diff: %v\n", err)
+			os.Exit(1)
+		}
+
+		switch {
+		case hasFlag(flags, "--json"):
+			if entries == nil {
+				entries = []DiffEntry{}
+			}
+			data, _ := json.MarshalIndent(entries, "", "  ")
+			fmt.Println(string(data))
+		case hasFlag(flags, "--name-only"):
+			for _, e := range entries {
+				fmt.Println(e.Path)
+			}
+		case hasFlag(flags, "--stat"):
+			counts := make(map[string]int)
+			var added, removed int64
+			for _, e := range entries {
+				counts[e.Change]++
+				if e.NewSize > e.OldSize {
+					added += e.NewSize - e.OldSize
+				} else {
+					removed += e.OldSize - e.NewSize
+				}
+				fmt.Printf(" %s %s | %s -> %s\n", diffLetter(e.Change), e.Path,
+					formatBytes(e.OldSize), formatBytes(e.NewSize))
+			}
+			fmt.Printf(" %d added, %d modified, %d deleted, %d metadata changed (+%s, -%s)\n",
+				counts[diffAdded], counts[diffModified], counts[diffDeleted], counts[diffMetadata],
+				formatBytes(added), formatBytes(removed))
+		default:
+			for _, e := range entries {
+				fmt.Printf("%s  %s\n", diffLetter(e.Change), e.Path)
+			}
+		}
+
+	case "rebase":
+		args, flags, err := parseArgs(os.Args[3:], "--onto=", "--force", "--json")
+		onto, useOnto := flags["--onto"]
+		if err != nil || (useOnto && (len(args) != 1 || onto == "")) || (!useOnto && len(args) != 2) {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> rebase <ref> <new-parent> [--force] [--json]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s <repo> rebase --onto <new-parent> <old-parent> [--force] [--json]\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		// With --onto, every child of the old parent but the new parent
+		// itself moves, taking its descendants along
+		newParent := onto
+		refNames := args[:1]
+		if !useOnto {
+			newParent = args[1]
+		} else {
+			refs, err := gt.ListRefs()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error listing refs: %v\n", err)
+				os.Exit(1)
+			}
+			refNames = nil
+			for _, r := range refs {
+				if r.Parent == args[0] && r.Name != newParent {
+					refNames = append(refNames, r.Name)
+				}
+			}
+			if len(refNames) == 0 {
+				fmt.Fprintf(os.Stderr, "Error: ref '%s' has no child refs\n", args[0])
+				os.Exit(1)
+			}
+		}
+
+		conflicts, err := gt.Rebase(refNames, newParent, hasFlag(flags, "--force"))
+		if hasFlag(flags, "--json") {
+			if conflicts == nil {
+				conflicts = []RebaseConflict{}
+			}
+			data, _ := json.MarshalIndent(conflicts, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			for _, c := range conflicts {
+				fmt.Printf("CONFLICT  %s: %s (%s in parent)\n", c.Ref, c.Path, c.Change)
+			}
+		}
+		if err != nil {
+			if len(conflicts) > 0 {
+				fmt.Fprintf(os.Stderr, "Error rebasing: %v (use --force to let the rebased refs win)\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Error rebasing: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		if !hasFlag(flags, "--json") {
+			fmt.Printf("Rebased %s onto '%s'\n", strings.Join(refNames, ", "), newParent)
+		}
+
+	case "reflog":
+		args, flags, err := parseArgs(os.Args[3:], "--json")
+		if err != nil || len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> reflog <ref> [--json]\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		entries, err := gt.Reflog(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading reflog: %v\n", err)
+			os.Exit(1)
+		}
+
+		if hasFlag(flags, "--json") {
+			data, _ := json.MarshalIndent(entries, "", "  ")
+			fmt.Println(string(data))
+			break
+		}
+		for i, e := range entries {
+			fmt.Printf("%3d  %s  %-12s %s\n", i+1, e.Time.Format("2006-01-02 15:04:05"), e.User, e.Op)
+		}
+
+	case "undo":
+		if len(os.Args) < 4 || len(os.Args) > 5 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> undo <ref> [n]\n", os.Args[0])
+			os.Exit(1)
+		}
+		refName := os.Args[3]
+		n := 1
+		if len(os.Args) == 5 {
+			var err error
+			n, err = strconv.Atoi(os.Args[4])
+			if err != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "Error: invalid reflog entry number: %s\n", os.Args[4])
+				os.Exit(1)
+			}
+		}
+
+		entry, err := gt.Undo(refName, n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error undoing: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored ref '%s' to its state before '%s' (%s)\n",
+			refName, entry.Op, entry.Time.Format("2006-01-02 15:04:05"))
+
+	case "merge":
+		args, flags, err := parseArgs(os.Args[3:], "--json")
+		if err != nil || len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> merge <target> <source> [--json]\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		result, err := gt.Merge(args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error merging: %v\n", err)
+			os.Exit(1)
+		}
+
+		if hasFlag(flags, "--json") {
+			data, _ := json.MarshalIndent(result, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			for _, c := range result.Conflicts {
+				if c.Key != "" {
+					fmt.Printf("CONFLICT  metadata %s: %s\n", c.Key, c.Reason)
+				} else {
+					fmt.Printf("CONFLICT  %s: %s\n", c.Path, c.Reason)
+				}
+			}
+			if result.Changed == 0 && len(result.Conflicts) == 0 {
+				fmt.Println("Already up to date")
+			} else {
+				fmt.Printf("Merged '%s' into '%s' (base '%s'): %d paths changed, %d conflicts\n",
+					args[1], args[0], result.Ancestor, result.Changed, len(result.Conflicts))
+			}
+		}
+		if len(result.Conflicts) > 0 {
+			os.Exit(1)
+		}
+
+	case "squash":
+		args, flags, err := parseArgs(os.Args[3:], "--into=", "--layers=")
+		if err != nil || len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> squash <ref> [--into <new-ref>|--layers <n>]\n", os.Args[0])
+			os.Exit(1)
+		}
+		top := 0
+		if value, ok := flags["--layers"]; ok {
+			top, err = strconv.Atoi(value)
+			if err != nil || top < 1 {
+				fmt.Fprintf(os.Stderr, "Error: invalid layer count: %s\n", value)
+				os.Exit(1)
+			}
+		}
+		if top > 0 && flags["--into"] != "" {
+			fmt.Fprintf(os.Stderr, "Error: --into and --layers cannot be combined\n")
+			os.Exit(1)
+		}
+
+		if err := gt.Squash(args[0], flags["--into"], top); err != nil {
+			fmt.Fprintf(os.Stderr, "Error squashing ref: %v\n", err)
+			os.Exit(1)
+		}
+		if into := flags["--into"]; into != "" {
+			fmt.Printf("Squashed '%s' into new ref '%s'\n", args[0], into)
+		} else {
+			fmt.Printf("Squashed ref '%s'\n", args[0])
+		}
+
 	case "size":
 		if len(os.Args) < 4 {
 			os.Exit(1)
@@ -686,13 +1559,26 @@ func main() {
 			}
 			seen[current.LayerID] = true
 
-			layerPath := filepath.Join(gt.repoPath, "layers", current.LayerID)
-			s, err := dirSize(layerPath)
-			if err == nil {
-				totalSize += s
+			for _, layerID := range refLayerIDs(current) {
+				layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+				s, err := dirSize(layerPath)
+				if err == nil {
+					totalSize += s
+				}
 			}
 
 			if current.Parent == "" {
+				// A ref created from a tag sits on the tag's layers
+				tag, err := gt.getTag(current.Tag)
+				if current.Tag == "" || err != nil {
+					break
+				}
+				for _, layerID := range tag.Layers {
+					s, err := dirSize(filepath.Join(gt.repoPath, "layers", layerID))
+					if err == nil {
+						totalSize += s
+					}
+				}
 				break
 			}
 
@@ -705,6 +1591,175 @@ func main() {
 
 		fmt.Printf("%d\n", totalSize)
 
+	case "dedup":
+		mode := gt.config.ObjectStore
+		if mode == "" {
+			mode = "hardlink"
+		}
+		if len(os.Args) > 3 {
+			switch os.Args[3] {
+			case "--hardlink":
+				mode = "hardlink"
+			case "--reflink":
+				mode = "reflink"
+			default:
+				fmt.Fprintf(os.Stderr, "Usage: %s <repo> dedup [--hardlink|--reflink]\n", os.Args[0])
+				os.Exit(1)
+			}
+		}
+
+		stats, err := gt.Dedup(mode)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error deduplicating: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Scanned %d files, linked %d duplicates, reclaimed %s\n",
+			stats.Files, stats.Linked, formatBytes(stats.Reclaimed))
+
+	case "gc":
+		var opts GCOptions
+		for _, arg := range os.Args[3:] {
+			switch arg {
+			case "--dry-run", "-n":
+				opts.DryRun = true
+			default:
+				fmt.Fprintf(os.Stderr, "Usage: %s <repo> gc [--dry-run]\n", os.Args[0])
+				os.Exit(1)
+			}
+		}
+
+		report, err := gt.GC(opts)
+		if report != nil {
+			verb := "Removed"
+			if opts.DryRun {
+				verb = "Would remove"
+			}
+			for _, item := range report.Items {
+				fmt.Printf("%s %s %s (%s)\n", verb, item.Kind, item.Path, formatBytes(item.Size))
+			}
+			fmt.Printf("%s %d layers, %d work dirs, %d commits, %d mount records, %d temp dirs, %d objects: %s\n",
+				verb, report.Count("layer"), report.Count("work"), report.Count("commit"),
+				report.Count("mount"), report.Count("tmp"), report.Count("object"), formatBytes(report.Size()))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error collecting garbage: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "fsck":
+		repair := false
+		for _, arg := range os.Args[3:] {
+			switch arg {
+			case "--repair":
+				repair = true
+			default:
+				fmt.Fprintf(os.Stderr, "Usage: %s <repo> fsck [--repair]\n", os.Args[0])
+				os.Exit(1)
+			}
+		}
+
+		problems, err := gt.Fsck(repair)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking repository: %v\n", err)
+			os.Exit(1)
+		}
+		for _, p := range problems {
+			if !p.Repaired {
+				os.Exit(1)
+			}
+		}
+
+	case "config":
+		if len(os.Args) < 4 {
+			for _, key := range configKeys {
+				value, _ := gt.GetConfig(key)
+				fmt.Printf("%s=%s\n", key, value)
+			}
+			break
+		}
+		key := os.Args[3]
+
+		if len(os.Args) > 4 {
+			if err := gt.SetConfig(key, os.Args[4]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error setting config: %v\n", err)
+				os.Exit(1)
+			}
+			break
+		}
+
+		value, err := gt.GetConfig(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", value)
+
+	case "import":
+		args, flags, err := parseArgs(os.Args[3:], "--parent=", "--format=")
+		if err == nil && flags["--format"] == "oci" && len(args) == 1 {
+			// The ref is named after the tag, or the layout directory
+			dir, tag := splitOCIRef(args[0])
+			name := tag
+			if name == "" {
+				name = filepath.Base(filepath.Clean(dir))
+			}
+			args = []string{name, args[0]}
+		}
+		if err != nil || len(args) != 2 || (flags["--format"] == "oci" && flags["--parent"] != "") {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> import <name> <dir|tar> [--parent <ref>]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "   or: %s <repo> import --format oci [name] <dir>[:tag]\n", os.Args[0])
+			os.Exit(1)
+		}
+		name, source := args[0], args[1]
+
+		switch flags["--format"] {
+		case "", "tar", "dir":
+			err = gt.Import(name, source, flags["--parent"])
+		case "oci":
+			dir, tag := splitOCIRef(source)
+			err = gt.ImportOCI(name, dir, tag)
+		default:
+			err = fmt.Errorf("unknown format: %s", flags["--format"])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error importing: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %s as ref %s\n", source, name)
+
+	case "export":
+		args, flags, err := parseArgs(os.Args[3:], "-o=", "--output=", "--format=")
+		output := flags["-o"] + flags["--output"]
+		if err == nil && flags["--format"] == "oci" && len(args) == 2 && output == "" {
+			args, output = args[:1], args[1]
+		}
+		if err != nil || len(args) != 1 || output == "" {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> export <ref> -o <rootfs.tar[.gz|.zst]>\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "   or: %s <repo> export --format oci <ref> <dir>[:tag]\n", os.Args[0])
+			os.Exit(1)
+		}
+		refName := args[0]
+
+		switch flags["--format"] {
+		case "", "tar":
+			err = gt.ExportFile(refName, output)
+		case "oci":
+			dir, tag := splitOCIRef(output)
+			err = gt.ExportOCI(refName, dir, tag)
+		default:
+			err = fmt.Errorf("unknown format: %s", flags["--format"])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error exporting: %v\n", err)
+			os.Exit(1)
+		}
+		if output != "-" {
+			fmt.Printf("Exported %s to %s\n", refName, output)
+		}
+
 	case "delete", "rm":
 		if len(os.Args) < 4 {
 			fmt.Fprintf(os.Stderr, "Usage: %s <repo> delete <ref> [--force]\n", os.Args[0])
@@ -718,7 +1773,146 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error deleting ref: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("Deleted ref: %s\n", refName)
+		fmt.Printf("Deleted ref: %s (moved to the trash, 'restore %s' brings it back)\n", refName, refName)
+
+	case "rename":
+		if len(os.Args) != 5 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> rename <old> <new>\n", os.Args[0])
+			os.Exit(1)
+		}
+		if err := gt.RenameRef(os.Args[3], os.Args[4]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error renaming ref: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Renamed %s to %s\n", os.Args[3], os.Args[4])
+
+	case "copy":
+		if len(os.Args) != 5 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> copy <src> <dst>\n", os.Args[0])
+			os.Exit(1)
+		}
+		if err := gt.CopyRef(os.Args[3], os.Args[4]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error copying ref: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Copied %s to %s\n", os.Args[3], os.Args[4])
+
+	case "tag":
+		if len(os.Args) < 4 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> tag <name> <ref>[@commit] [-m message]\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s <repo> tag list\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s <repo> tag delete <name>\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		switch os.Args[3] {
+		case "list":
+			tags, err := gt.ListTags()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error listing tags: %v\n", err)
+				os.Exit(1)
+			}
+			for _, tag := range tags {
+				message := ""
+				if tag.Message != "" {
+					message = " - " + strings.SplitN(tag.Message, "\n", 2)[0]
+				}
+				fmt.Printf("%s -> %s@%.12s by %s, %s%s\n", tag.Name, tag.Ref, tag.Commit, tag.Author,
+					tag.CreatedAt.Format("2006-01-02 15:04:05"), message)
+			}
+
+		case "delete":
+			if len(os.Args) != 5 {
+				fmt.Fprintf(os.Stderr, "Usage: %s <repo> tag delete <name>\n", os.Args[0])
+				os.Exit(1)
+			}
+			if err := gt.DeleteTag(os.Args[4]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error deleting tag: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Deleted tag %s\n", os.Args[4])
+
+		default:
+			args, flags, err := parseArgs(os.Args[3:], "-m=", "--message=")
+			if err != nil || len(args) != 2 {
+				fmt.Fprintf(os.Stderr, "Usage: %s <repo> tag <name> <ref>[@commit] [-m message]\n", os.Args[0])
+				os.Exit(1)
+			}
+			message := flags["-m"]
+			if value, ok := flags["--message"]; ok {
+				message = value
+			}
+
+			tag, err := gt.CreateTag(args[0], args[1], message)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating tag: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Tagged %s@%.12s as %s\n", tag.Ref, tag.Commit, tag.Name)
+		}
+
+	case "restore":
+		if len(os.Args) != 4 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> restore <ref|trash-id>\n", os.Args[0])
+			os.Exit(1)
+		}
+		entry, err := gt.Restore(os.Args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error restoring ref: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored ref: %s (deleted %s)\n", entry.Name, entry.DeletedAt.Format("2006-01-02 15:04:05"))
+
+	case "trash":
+		if len(os.Args) < 4 {
+			fmt.Fprintf(os.Stderr, "Usage: %s <repo> trash list|empty [--older-than <age>]\n", os.Args[0])
+			os.Exit(1)
+		}
+
+		switch os.Args[3] {
+		case "list":
+			entries, err := gt.ListTrash()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error listing trash: %v\n", err)
+				os.Exit(1)
+			}
+			if len(entries) == 0 {
+				fmt.Println("Trash is empty")
+			}
+			for _, e := range entries {
+				size, _ := dirSize(gt.trashPath(e.ID))
+				fmt.Printf("%s  %s  deleted %s by %s, %s\n", e.ID, e.Name,
+					e.DeletedAt.Format("2006-01-02 15:04:05"), e.User, formatBytes(size))
+			}
+
+		case "empty":
+			_, flags, err := parseArgs(os.Args[4:], "--older-than=")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Usage: %s <repo> trash empty [--older-than <age>]\n", os.Args[0])
+				os.Exit(1)
+			}
+			var olderThan time.Duration
+			if value, ok := flags["--older-than"]; ok {
+				if olderThan, err = parseAge(value); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			removed, err := gt.EmptyTrash(olderThan)
+			for _, e := range removed {
+				fmt.Printf("Removed %s\n", e.ID)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error emptying trash: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Removed %d trash entries\n", len(removed))
+
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown trash subcommand: %s\n", os.Args[3])
+			os.Exit(1)
+		}
 
 	case "metadata":
 		if len(os.Args) < 4 {
@@ -811,25 +2005,135 @@ func main() {
 	}
 }
 
+// parseArgs splits command arguments into positional arguments and flags.
+// Each spec names an accepted flag; a spec ending in "=" takes the next
+// argument (or the part after "=") as its value.
+func parseArgs(args []string, specs ...string) ([]string, map[string]string, error) {
+	var positional []string
+	flags := make(map[string]string)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		known := false
+		for _, spec := range specs {
+			if spec == name && !hasValue {
+				flags[name] = ""
+				known = true
+			} else if spec == name+"=" {
+				if !hasValue {
+					if i+1 >= len(args) {
+						return nil, nil, fmt.Errorf("flag %s needs a value", name)
+					}
+					i++
+					value = args[i]
+				}
+				flags[name] = value
+				known = true
+			}
+		}
+		if !known {
+			return nil, nil, fmt.Errorf("unknown flag: %s", arg)
+		}
+	}
+
+	return positional, flags, nil
+}
+
+// hasFlag reports whether parseArgs saw the flag
+func hasFlag(flags map[string]string, name string) bool {
+	_, ok := flags[name]
+	return ok
+}
+
 func printUsage() {
 	fmt.Println("GoTree - OSTree-like system in Go")
 	fmt.Println("\nUsage:")
-	fmt.Println("  gotree <repo> list")
+	fmt.Println("  gotree <repo> list [namespace|glob]")
+	fmt.Println("  gotree <repo> tree [root] [--dot]")
 	fmt.Println("  gotree <repo> create <name> [parent]")
-	fmt.Println("  gotree <repo> mount <ref> <mountpoint>")
-	fmt.Println("  gotree <repo> unmount <mountpoint>")
+	fmt.Println("  gotree <repo> mount <ref|tag> <mountpoint>")
+	fmt.Println("  gotree <repo> mount --read-only <ref>[@commit] <mountpoint>")
+	fmt.Println("  gotree <repo> mount --ephemeral [--tmpfs] <ref> <mountpoint>")
+	fmt.Println("  gotree <repo> mount --workspace <ref> <mountpoint>")
+	fmt.Println("  gotree <repo> unmount <mountpoint> [--force] [--promote <new-ref>|--discard]")
+	fmt.Println("  gotree <repo> mount --restore")
+	fmt.Println("  gotree <repo> mounts")
+	fmt.Println("  gotree <repo> automount --fstab|--systemd <dir>")
 	fmt.Println("  gotree <repo> commit <ref> [message]")
+	fmt.Println("  gotree <repo> commit --workspace <mountpoint> [message]")
+	fmt.Println("  gotree <repo> log <ref> [--oneline|--json]")
+	fmt.Println("  gotree <repo> diff <refA> [refB] [--stat|--name-only|--json]")
 	fmt.Println("  gotree <repo> size <ref>")
+	fmt.Println("  gotree <repo> squash <ref> [--into <new-ref>|--layers <n>]")
+	fmt.Println("  gotree <repo> reflog <ref> [--json]")
+	fmt.Println("  gotree <repo> undo <ref> [n]")
+	fmt.Println("  gotree <repo> merge <target> <source> [--json]")
+	fmt.Println("  gotree <repo> rebase <ref> <new-parent> [--force] [--json]")
+	fmt.Println("  gotree <repo> rebase --onto <new-parent> <old-parent> [--force] [--json]")
+	fmt.Println("  gotree <repo> import <name> <dir|tar> [--parent <ref>]")
+	fmt.Println("  gotree <repo> import --format oci [name] <dir>[:tag]")
+	fmt.Println("  gotree <repo> export <ref> -o <rootfs.tar[.gz|.zst]>")
+	fmt.Println("  gotree <repo> export --format oci <ref> <dir>[:tag]")
+	fmt.Println("  gotree <repo> dedup [--hardlink|--reflink]")
+	fmt.Println("  gotree <repo> gc [--dry-run]")
+	fmt.Println("  gotree <repo> fsck [--repair]")
+	fmt.Println("  gotree <repo> config [key] [value]")
 	fmt.Println("  gotree <repo> delete <ref> [--force]")
 	fmt.Println("  gotree <repo> rm <ref> [--force]          (alias)")
+	fmt.Println("  gotree <repo> restore <ref|trash-id>")
+	fmt.Println("  gotree <repo> rename <old> <new>")
+	fmt.Println("  gotree <repo> copy <src> <dst>")
+	fmt.Println("  gotree <repo> tag <name> <ref>[@commit] [-m message]")
+	fmt.Println("  gotree <repo> tag list")
+	fmt.Println("  gotree <repo> tag delete <name>")
+	fmt.Println("  gotree <repo> trash list")
+	fmt.Println("  gotree <repo> trash empty [--older-than <age>]")
 	fmt.Println("\nExamples:")
 	fmt.Println("  gotree /var/lib/gotree list")
+	fmt.Println("  gotree /var/lib/gotree list 'team/alice/*'")
+	fmt.Println("  gotree /var/lib/gotree tree --dot | dot -Tsvg > refs.svg")
 	fmt.Println("  gotree /var/lib/gotree create base")
 	fmt.Println("  gotree /var/lib/gotree create dev base")
+	fmt.Println("  gotree /var/lib/gotree create team/alice/feature-x dev")
 	fmt.Println("  gotree /var/lib/gotree mount dev /mnt/dev")
+	fmt.Println("  gotree /var/lib/gotree mount --read-only dev@3f9a2c1e /mnt/dev-old")
 	fmt.Println("  gotree /var/lib/gotree unmount /mnt/dev")
+	fmt.Println("  gotree /var/lib/gotree mounts")
+	fmt.Println("  gotree /var/lib/gotree mount --restore")
+	fmt.Println("  gotree /var/lib/gotree metadata set dev automount /mnt/dev")
+	fmt.Println("  gotree /var/lib/gotree automount --systemd /etc/systemd/system")
+	fmt.Println("  gotree /var/lib/gotree mount --ephemeral --tmpfs dev /mnt/test")
+	fmt.Println("  gotree /var/lib/gotree unmount /mnt/test --promote dev-fix")
 	fmt.Println("  gotree /var/lib/gotree commit dev 'Added new files'")
+	fmt.Println("  gotree /var/lib/gotree mount --workspace dev /mnt/dev2")
+	fmt.Println("  gotree /var/lib/gotree commit --workspace /mnt/dev2 'Fixed the build'")
+	fmt.Println("  gotree /var/lib/gotree log dev --oneline")
+	fmt.Println("  gotree /var/lib/gotree diff dev --stat")
 	fmt.Println("  gotree /var/lib/gotree size dev")
+	fmt.Println("  gotree /var/lib/gotree squash dev --layers 5")
+	fmt.Println("  gotree /var/lib/gotree reflog dev")
+	fmt.Println("  gotree /var/lib/gotree undo dev 2")
+	fmt.Println("  gotree /var/lib/gotree merge dev feature")
+	fmt.Println("  gotree /var/lib/gotree rebase dev base-v2")
+	fmt.Println("  gotree /var/lib/gotree rebase --onto base-v2 base-v1")
+	fmt.Println("  gotree /var/lib/gotree import base-v2 rootfs.tar.gz --parent base")
+	fmt.Println("  gotree /var/lib/gotree export dev -o rootfs.tar.zst")
+	fmt.Println("  gotree /var/lib/gotree export --format oci dev ./image:latest")
+	fmt.Println("  gotree /var/lib/gotree config object_store hardlink")
+	fmt.Println("  gotree /var/lib/gotree dedup")
+	fmt.Println("  gotree /var/lib/gotree gc --dry-run")
 	fmt.Println("  gotree /var/lib/gotree delete old-experiment")
 	fmt.Println("  gotree /var/lib/gotree rm base --force")
+	fmt.Println("  gotree /var/lib/gotree restore old-experiment")
+	fmt.Println("  gotree /var/lib/gotree rename dev dev-old")
+	fmt.Println("  gotree /var/lib/gotree copy dev dev-backup")
+	fmt.Println("  gotree /var/lib/gotree tag release-2026-10 dev@3f9a2c1e")
+	fmt.Println("  gotree /var/lib/gotree create hotfix release-2026-10")
+	fmt.Println("  gotree /var/lib/gotree trash empty --older-than 7d")
 }
\ No newline at end of file
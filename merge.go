@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MergeConflict is a path or metadata key changed differently on both
+// sides of a merge. The target's version is kept; for files, the source's
+// version is written next to it as <path>.theirs and the common ancestor's
+// as <path>.orig.
+type MergeConflict struct {
+	Path   string `json:"path,omitempty"`
+	Key    string `json:"key,omitempty"` // metadata key, for metadata conflicts
+	Reason string `json:"reason"`
+}
+
+// MergeResult describes what a merge did
+type MergeResult struct {
+	Ancestor  string          `json:"ancestor"`
+	Changed   int             `json:"changed"` // paths taken from the source
+	Conflicts []MergeConflict `json:"conflicts"`
+	Commit    string          `json:"commit,omitempty"`
+}
+
+// Merge does a file-level three-way merge of source into target, using
+// their closest common ancestor in the parent chain as the base. Changes
+// from the source land in a new sealed layer on top of the target's
+// layers, recorded as a commit. Metadata is merged with the same rules.
+func (gt *GoTree) Merge(target, source string) (*MergeResult, error) {
+	ours, err := gt.getRef(target)
+	if err != nil {
+		return nil, fmt.Errorf("ref not found: %w", err)
+	}
+	theirs, err := gt.getRef(source)
+	if err != nil {
+		return nil, fmt.Errorf("ref not found: %w", err)
+	}
+
+	ancestor, err := gt.commonAncestor(ours, theirs)
+	if err != nil {
+		return nil, err
+	}
+	result := &MergeResult{Ancestor: ancestor.Name, Conflicts: []MergeConflict{}}
+	if ancestor.Name == theirs.Name {
+		return result, nil // the target already sits on top of the source
+	}
+
+	// The merge layer goes below the upper layer, which must hold nothing
+	// that it would end up hiding
+	names, err := readDirNames(filepath.Join(gt.repoPath, "layers", ours.LayerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upper layer: %w", err)
+	}
+	if len(names) > 0 {
+		return nil, fmt.Errorf("ref '%s' has uncommitted changes, commit them first", target)
+	}
+	affected, err := gt.descendants(target)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append([]string{target}, affected...) {
+		mounted, err := gt.IsMountedRef(name)
+		if err != nil {
+			return nil, err
+		}
+		if mounted {
+			return nil, fmt.Errorf("cannot merge into '%s': ref '%s' is currently mounted", target, name)
+		}
+	}
+
+	baseView, err := readMergedView(gt.refStack(ancestor))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", ancestor.Name, err)
+	}
+	ourView, err := readMergedView(gt.refStack(ours))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", target, err)
+	}
+	theirView, err := readMergedView(gt.refStack(theirs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", source, err)
+	}
+
+	layerID := gt.generateLayerID()
+	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+	if err := os.Mkdir(layerPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create layer: %w", err)
+	}
+
+	m := &mergeWriter{base: baseView, ours: ourView, theirs: theirView, layer: layerPath}
+	if err := m.merge(); err != nil {
+		os.RemoveAll(layerPath)
+		return nil, fmt.Errorf("failed to merge '%s' into '%s': %w", source, target, err)
+	}
+	result.Changed = m.changed
+	result.Conflicts = append(result.Conflicts, m.conflicts...)
+
+	metadata, metaConflicts := mergeMetadata(ancestor.Metadata, ours.Metadata, theirs.Metadata)
+	result.Conflicts = append(result.Conflicts, metaConflicts...)
+
+	if m.changed == 0 && len(m.conflicts) == 0 {
+		os.RemoveAll(layerPath)
+		ours.Metadata = metadata
+		return result, gt.saveRef(*ours, "merge "+source)
+	}
+
+	message := fmt.Sprintf("Merge '%s' into '%s'", source, target)
+	if len(result.Conflicts) > 0 {
+		message += fmt.Sprintf(" (%d conflicts)", len(result.Conflicts))
+	}
+	metadata["commit.message"] = message
+	ours.Metadata = metadata
+
+	commit, err := gt.newCommit(ours, layerID, gt.lowerLayerIDs(ours), message, time.Now())
+	if err != nil {
+		os.RemoveAll(layerPath)
+		return nil, err
+	}
+	ours.Layers = append([]string{layerID}, ours.Layers...)
+	ours.Head = commit.ID
+	if err := gt.saveRef(*ours, "merge "+source); err != nil {
+		os.RemoveAll(layerPath)
+		return nil, fmt.Errorf("failed to save ref: %w", err)
+	}
+	result.Commit = commit.ID
+	return result, nil
+}
+
+// commonAncestor finds the closest ref that both a and b are built on,
+// either of them included
+func (gt *GoTree) commonAncestor(a, b *Ref) (*Ref, error) {
+	chain := make(map[string]bool)
+	for r := a; r != nil && !chain[r.Name]; r = gt.parentRef(r) {
+		chain[r.Name] = true
+	}
+
+	seen := make(map[string]bool)
+	for r := b; r != nil && !seen[r.Name]; r = gt.parentRef(r) {
+		if chain[r.Name] {
+			return r, nil
+		}
+		seen[r.Name] = true
+	}
+	return nil, fmt.Errorf("refs '%s' and '%s' have no common ancestor", a.Name, b.Name)
+}
+
+// parentRef returns the parent of ref, or nil at the root of the chain
+func (gt *GoTree) parentRef(ref *Ref) *Ref {
+	if ref.Parent == "" {
+		return nil
+	}
+	parent, err := gt.getRef(ref.Parent)
+	if err != nil {
+		return nil
+	}
+	return parent
+}
+
+// mergeWriter writes the changes a merge takes from the source into a
+// layer placed on top of the target's stack
+type mergeWriter struct {
+	base, ours, theirs *mergedView
+	layer              string
+	changed            int
+	conflicts          []MergeConflict
+	dirs               []string // layer directories whose times still need fixing
+	times              []fileAttrs
+}
+
+func (m *mergeWriter) merge() error {
+	paths := make(map[string]bool)
+	for _, view := range []*mergedView{m.base, m.ours, m.theirs} {
+		for rel := range view.entries {
+			paths[rel] = true
+		}
+	}
+	sorted := make([]string, 0, len(paths))
+	for rel := range paths {
+		sorted = append(sorted, rel)
+	}
+	sort.Strings(sorted)
+
+	root := m.ours.entries["."]
+	attrs, err := attrsFromInfo(root.Path, root.Info)
+	if err != nil {
+		return err
+	}
+	if err := attrs.apply(m.layer); err != nil {
+		return err
+	}
+	m.dirs = append(m.dirs, m.layer)
+	m.times = append(m.times, attrs)
+
+	skip := ""
+	for _, rel := range sorted {
+		if skip != "" && strings.HasPrefix(rel, skip+"/") {
+			continue
+		}
+		skip = ""
+
+		whole, err := m.path(rel)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		if whole {
+			skip = rel
+		}
+	}
+
+	for i := len(m.dirs) - 1; i >= 0; i-- {
+		if err := lutimes(m.dirs[i], m.times[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path merges one path. It returns true when it dealt with everything
+// below the path as well.
+func (m *mergeWriter) path(rel string) (bool, error) {
+	b, inBase := m.base.entries[rel]
+	o, inOurs := m.ours.entries[rel]
+	t, inTheirs := m.theirs.entries[rel]
+
+	theirsChanged, err := entryChanged(b, inBase, t, inTheirs)
+	if err != nil || !theirsChanged {
+		return false, err
+	}
+	oursChanged, err := entryChanged(b, inBase, o, inOurs)
+	if err != nil {
+		return false, err
+	}
+
+	if !oursChanged {
+		// Replacing or deleting a directory also drops whatever the
+		// target changed below it
+		if inOurs && o.Info.IsDir() && !(inTheirs && t.Info.IsDir()) {
+			changed, err := m.subtreeChanged(rel)
+			if err != nil {
+				return false, err
+			}
+			if changed {
+				m.conflict(rel, "replaced in source, changed below in target", b, inBase, t, inTheirs)
+				return true, nil
+			}
+		}
+
+		m.changed++
+		if !inTheirs {
+			if err := m.ensureDir(filepath.Dir(rel)); err != nil {
+				return false, err
+			}
+			return true, makeWhiteout(filepath.Join(m.layer, rel))
+		}
+		return !t.Info.IsDir(), m.take(rel, rel, t)
+	}
+
+	differ, err := entryChanged(o, inOurs, t, inTheirs)
+	if err != nil || !differ {
+		return false, err
+	}
+
+	switch {
+	case !inTheirs:
+		m.conflict(rel, "deleted in source, changed in target", b, inBase, t, inTheirs)
+	case !inOurs:
+		m.conflict(rel, "deleted in target, changed in source", b, inBase, t, inTheirs)
+	case o.Info.IsDir() && t.Info.IsDir():
+		m.conflict(rel, "attributes changed on both sides", b, inBase, t, inTheirs)
+		return false, nil
+	default:
+		m.conflict(rel, "changed on both sides", b, inBase, t, inTheirs)
+	}
+	return true, nil
+}
+
+// conflict records a conflicting path and writes the source and ancestor
+// versions of files next to the target's
+func (m *mergeWriter) conflict(rel, reason string, b mergedEntry, inBase bool, t mergedEntry, inTheirs bool) {
+	m.conflicts = append(m.conflicts, MergeConflict{Path: rel, Reason: reason})
+
+	// Side files can only go where the target still has the directory
+	parent, ok := m.ours.entries[filepath.Dir(rel)]
+	if !ok || !parent.Info.IsDir() {
+		return
+	}
+	if inTheirs && !t.Info.IsDir() {
+		if err := m.take(rel+".theirs", rel, t); err != nil {
+			m.conflicts[len(m.conflicts)-1].Reason += fmt.Sprintf(" (cannot write %s.theirs: %v)", rel, err)
+		}
+	}
+	if inBase && !b.Info.IsDir() {
+		if err := m.take(rel+".orig", rel, b); err != nil {
+			m.conflicts[len(m.conflicts)-1].Reason += fmt.Sprintf(" (cannot write %s.orig: %v)", rel, err)
+		}
+	}
+}
+
+// take copies an entry into the layer at rel. Directories are copied
+// without their contents and never opaque, so they merge with the target.
+func (m *mergeWriter) take(rel, from string, e mergedEntry) error {
+	if err := m.ensureDir(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	target := filepath.Join(m.layer, rel)
+	if rel != "." {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	if err := copyEntry(e.Path, target, e.Info, true); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", from, err)
+	}
+	if e.Info.IsDir() {
+		if err := removeXattr(target, opaqueXattr); err != nil && err != syscall.ENODATA {
+			return err
+		}
+		attrs, err := attrsFromInfo(e.Path, e.Info)
+		if err != nil {
+			return err
+		}
+		m.dirs = append(m.dirs, target)
+		m.times = append(m.times, attrs)
+	}
+	return nil
+}
+
+// ensureDir creates rel and its parents in the layer, as they are in the
+// target or, for directories only the source has, in the source
+func (m *mergeWriter) ensureDir(rel string) error {
+	if _, err := os.Lstat(filepath.Join(m.layer, rel)); err == nil {
+		return nil
+	}
+	if err := m.ensureDir(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	for _, view := range []*mergedView{m.ours, m.theirs} {
+		if e, ok := view.entries[rel]; ok && e.Info.IsDir() {
+			return m.take(rel, rel, e)
+		}
+	}
+	return fmt.Errorf("no directory %s to merge into", rel)
+}
+
+// subtreeChanged reports whether the target changed anything below the
+// directory rel since the common ancestor
+func (m *mergeWriter) subtreeChanged(rel string) (bool, error) {
+	prefix := rel + "/"
+	for path, o := range m.ours.entries {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		b, ok := m.base.entries[path]
+		changed, err := entryChanged(b, ok, o, true)
+		if err != nil || changed {
+			return changed, err
+		}
+	}
+	for path := range m.base.entries {
+		if _, ok := m.ours.entries[path]; strings.HasPrefix(path, prefix) && !ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// entryChanged reports whether two versions of a path, either possibly
+// missing, differ. Directories are compared by their attributes only.
+func entryChanged(a mergedEntry, inA bool, b mergedEntry, inB bool) (bool, error) {
+	if !inA || !inB {
+		return inA != inB, nil
+	}
+	if a.Path == b.Path {
+		return false, nil
+	}
+	change, err := compareEntries(a.Path, a.Info, b.Path, b.Info)
+	return change != changeNone, err
+}
+
+// mergeMetadata merges metadata maps with the same rules as files: a key
+// changed on one side only takes that side's value, and a key changed
+// differently on both sides keeps the target's value and is reported
+func mergeMetadata(base, ours, theirs map[string]string) (map[string]string, []MergeConflict) {
+	merged := make(map[string]string)
+	for k, v := range ours {
+		merged[k] = v
+	}
+
+	keys := make(map[string]bool)
+	for _, m := range []map[string]string{base, ours, theirs} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var conflicts []MergeConflict
+	for _, k := range sorted {
+		if k == "commit.message" {
+			continue // describes the last commit, which the merge replaces
+		}
+		b, inBase := base[k]
+		o, inOurs := ours[k]
+		t, inTheirs := theirs[k]
+
+		theirsChanged := inBase != inTheirs || b != t
+		oursChanged := inBase != inOurs || b != o
+		switch {
+		case !theirsChanged:
+		case !oursChanged:
+			if inTheirs {
+				merged[k] = t
+			} else {
+				delete(merged, k)
+			}
+		case inOurs != inTheirs || o != t:
+			conflicts = append(conflicts, MergeConflict{Key: k, Reason: "changed on both sides"})
+		}
+	}
+	return merged, conflicts
+}
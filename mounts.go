@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// mountRecord is what mounts/<hash>.json says about one mount. Records
+// from before read-only mounts have no mode and are read-write.
+type mountRecord struct {
+	Ref        string    `json:"ref,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	MountPoint string    `json:"mountPoint"`
+	Mode       string    `json:"mode,omitempty"`      // "rw", "ro", "ephemeral" or "workspace"
+	Commit     string    `json:"commit,omitempty"`    // commit shown by a read-only mount of an older state
+	Layers     []string  `json:"layers,omitempty"`    // lower layers of a read-only, ephemeral or workspace mount, topmost first
+	Scratch    string    `json:"scratch,omitempty"`   // upper and work dirs of an ephemeral mount
+	Tmpfs      bool      `json:"tmpfs,omitempty"`     // scratch dir is a tmpfs
+	Workspace  string    `json:"workspace,omitempty"` // upper layer of a workspace mount
+	PID        int       `json:"pid,omitempty"`       // process that mounted it
+	Created    time.Time `json:"created,omitempty"`
+
+	path string // the record file
+}
+
+// writesToRef reports whether the mount has the ref's own upper layer as
+// its upper dir
+func (r *mountRecord) writesToRef() bool {
+	return r.Ref != "" && (r.Mode == "" || r.Mode == "rw")
+}
+
+// mountRecordPath names a record after a hash of the absolute mount
+// point, so that mount points with the same base name get records of
+// their own
+func (gt *GoTree) mountRecordPath(mountPoint string) string {
+	if abs, err := filepath.Abs(mountPoint); err == nil {
+		mountPoint = abs
+	}
+	sum := sha256.Sum256([]byte(mountPoint))
+	return filepath.Join(gt.repoPath, "mounts", hex.EncodeToString(sum[:8])+".json")
+}
+
+// legacyMountRecordPath is where records were kept before they were named
+// by hash
+func (gt *GoTree) legacyMountRecordPath(mountPoint string) string {
+	return filepath.Join(gt.repoPath, "mounts", filepath.Base(mountPoint)+".json")
+}
+
+// saveMountRecord writes rec, stamping a new record with the process that
+// made the mount and the time. A record read from its old, base-named
+// file moves to its hashed name.
+func (gt *GoTree) saveMountRecord(rec *mountRecord) error {
+	if rec.Created.IsZero() {
+		rec.PID = os.Getpid()
+		rec.Created = time.Now()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal mount record: %w", err)
+	}
+	path := gt.mountRecordPath(rec.MountPoint)
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save mount record: %w", err)
+	}
+	if rec.path != "" && rec.path != path {
+		os.Remove(rec.path)
+	}
+	rec.path = path
+	return nil
+}
+
+// readMountRecords returns every mount record that can be parsed
+func (gt *GoTree) readMountRecords() ([]mountRecord, error) {
+	mountsDir := filepath.Join(gt.repoPath, "mounts")
+	entries, err := os.ReadDir(mountsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []mountRecord
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(mountsDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var rec mountRecord
+		if json.Unmarshal(data, &rec) != nil {
+			continue
+		}
+		rec.path = path
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// writableMountPoints returns the mount points where ref is mounted with
+// its upper layer
+func (gt *GoTree) writableMountPoints(refName string) ([]string, error) {
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return nil, err
+	}
+	var mountPoints []string
+	for _, rec := range records {
+		if rec.Ref == refName && rec.writesToRef() {
+			mountPoints = append(mountPoints, rec.MountPoint)
+		}
+	}
+	return mountPoints, nil
+}
+
+// mountRecordPending reports whether an unmounted record still has a
+// workspace layer or changes in a scratch dir, which are lost with the
+// record. gc keeps such records until they are promoted or discarded.
+func (gt *GoTree) mountRecordPending(rec *mountRecord) bool {
+	if rec.Workspace != "" && gt.layerExists(rec.Workspace) {
+		return true
+	}
+	return gt.mountHoldsChanges(rec)
+}
+
+// liveWritableMount returns a mount point where ref is mounted with its
+// upper layer as the upper dir right now, or "" if there is none
+func (gt *GoTree) liveWritableMount(refName string) (string, error) {
+	mountPoints, err := gt.writableMountPoints(refName)
+	if err != nil {
+		return "", err
+	}
+	for _, mp := range mountPoints {
+		if gt.isMounted(mp) {
+			return mp, nil
+		}
+	}
+	return "", nil
+}
+
+// mountsOnUpper returns the live mounts of ref that have its upper layer
+// as a lower dir. Overlayfs leaves it undefined what they show once the
+// upper layer is written to through another mount.
+func (gt *GoTree) mountsOnUpper(ref *Ref) ([]string, error) {
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return nil, err
+	}
+	var mountPoints []string
+	for _, rec := range records {
+		if rec.Ref == ref.Name && containsString(rec.Layers, ref.LayerID) && gt.isMounted(rec.MountPoint) {
+			mountPoints = append(mountPoints, rec.MountPoint)
+		}
+	}
+	return mountPoints, nil
+}
+
+// readMountRecord returns the record of the mount at mountPoint
+func (gt *GoTree) readMountRecord(mountPoint string) (*mountRecord, error) {
+	path := gt.mountRecordPath(mountPoint)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		rec, legacyErr := gt.readLegacyMountRecord(mountPoint)
+		if legacyErr == nil {
+			return rec, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec mountRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("mount record of %s is corrupt: %w", mountPoint, err)
+	}
+	rec.path = path
+	return &rec, nil
+}
+
+// readLegacyMountRecord reads a base-named record, as long as it is really
+// about mountPoint and not another one with the same base name
+func (gt *GoTree) readLegacyMountRecord(mountPoint string) (*mountRecord, error) {
+	abs, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	path := gt.legacyMountRecordPath(mountPoint)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec mountRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if rec.MountPoint != abs {
+		return nil, os.ErrNotExist
+	}
+	rec.path = path
+	return &rec, nil
+}
+
+// MountEntry is a mount record as the mounts command shows it
+type MountEntry struct {
+	mountRecord
+	Stale bool // recorded, but no longer mounted
+}
+
+// ListMounts returns every mount record sorted by mount point, with the
+// ones whose mount is gone marked stale
+func (gt *GoTree) ListMounts() ([]MountEntry, error) {
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount records: %w", err)
+	}
+	mounted, err := mountedPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]MountEntry, 0, len(records))
+	for _, rec := range records {
+		entries = append(entries, MountEntry{mountRecord: rec, Stale: !mounted[canonicalPath(rec.MountPoint)]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].MountPoint < entries[j].MountPoint })
+	return entries, nil
+}
+
+// mountedPaths returns the mount points in the mount table of this
+// process
+func mountedPaths() (map[string]bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+	defer f.Close()
+
+	// Fields are: mount ID, parent ID, major:minor, root, mount point, ...
+	paths := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		paths[unescapeMountInfo(fields[4])] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+	return paths, nil
+}
+
+// unescapeMountInfo undoes the octal escapes (\040 for a space and so on)
+// the kernel uses in mountinfo paths
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// canonicalPath is the absolute path with symlinks resolved, as the kernel
+// reports mount points
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// forgetMount removes the record of an unmounted mount point, along with
+// the scratch dirs of an ephemeral mount or the layer of a workspace
+func (gt *GoTree) forgetMount(mountPoint string) error {
+	rec, err := gt.readMountRecord(mountPoint)
+	if err != nil {
+		// A corrupt record is of no use either
+		if !os.IsNotExist(err) {
+			os.Remove(gt.mountRecordPath(mountPoint))
+		}
+		return nil
+	}
+	if err := os.Remove(rec.path); err != nil {
+		return fmt.Errorf("failed to remove mount record: %w", err)
+	}
+	if rec.Scratch != "" {
+		if err := gt.removeScratch(rec.Scratch); err != nil {
+			return fmt.Errorf("failed to discard changes of ephemeral mount: %w", err)
+		}
+	}
+	if rec.Workspace != "" {
+		if err := gt.removeWorkspace(rec.Workspace); err != nil {
+			return fmt.Errorf("failed to discard workspace: %w", err)
+		}
+	}
+	return nil
+}
+
+// MountReadOnly mounts a ref, or with "ref@commit" an older commit of it,
+// as an overlay made only of lower dirs. Without an upper or work dir
+// there is nothing to write to and nothing shared between mounts, so a
+// ref can be mounted read-only any number of times. A tag is mounted the
+// same way.
+func (gt *GoTree) MountReadOnly(spec, mountPoint string) error {
+	rec := &mountRecord{Mode: "ro"}
+	refName, _, hasCommit := strings.Cut(spec, "@")
+	ref, err := gt.getRef(refName)
+	switch {
+	case err != nil && !hasCommit:
+		tag, tagErr := gt.getTag(spec)
+		if tagErr != nil {
+			return fmt.Errorf("ref not found: %w", err)
+		}
+		rec.Tag = tag.Name
+		rec.Commit = tag.Commit
+		rec.Layers = tag.Layers
+	case err != nil:
+		return fmt.Errorf("ref not found: %w", err)
+	case hasCommit:
+		_, commit, err := gt.resolveCommit(spec)
+		if err != nil {
+			return err
+		}
+		rec.Ref = refName
+		rec.Commit = commit.ID
+		rec.Layers = append([]string{commit.LayerID}, commit.Lower...)
+	default:
+		// The upper layer must not change under the mount
+		mp, err := gt.liveWritableMount(refName)
+		if err != nil {
+			return err
+		}
+		if mp != "" {
+			return fmt.Errorf("ref '%s' is mounted writable on %s; unmount it first, or mount %s@<commit> to see a commit of it", refName, mp, refName)
+		}
+		rec.Ref = refName
+		rec.Layers = append([]string{ref.LayerID}, gt.lowerLayerIDs(ref)...)
+	}
+
+	for _, layerID := range rec.Layers {
+		if !gt.layerExists(layerID) {
+			return fmt.Errorf("cannot mount %s: layer %s is gone", spec, layerID)
+		}
+	}
+
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	if gt.isMounted(mountPoint) {
+		return fmt.Errorf("mount point already in use")
+	}
+	if rec.MountPoint, err = filepath.Abs(mountPoint); err != nil {
+		return err
+	}
+
+	if err := gt.mountReadOnly(rec.Layers, mountPoint); err != nil {
+		return err
+	}
+	if err := gt.saveMountRecord(rec); err != nil {
+		syscall.Unmount(mountPoint, 0)
+		return err
+	}
+	return nil
+}
+
+// mountReadOnly mounts a stack of layers, topmost first, without an upper
+// dir. Overlayfs needs at least two lower dirs for that, so a single
+// layer is bind mounted read-only instead.
+func (gt *GoTree) mountReadOnly(layerIDs []string, mountPoint string) error {
+	lowerDirs := gt.layerPaths(layerIDs)
+	if len(lowerDirs) > 1 {
+		opts := "lowerdir=" + strings.Join(lowerDirs, ":")
+		if err := syscall.Mount("overlay", mountPoint, "overlay", syscall.MS_RDONLY, opts); err != nil {
+			return fmt.Errorf("failed to mount overlay: %w", err)
+		}
+		return nil
+	}
+
+	if err := syscall.Mount(lowerDirs[0], mountPoint, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount layer: %w", err)
+	}
+	// The read-only flag only takes effect on a remount of the bind
+	if err := syscall.Mount("", mountPoint, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		syscall.Unmount(mountPoint, 0)
+		return fmt.Errorf("failed to make bind mount read-only: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DedupStats summarises a deduplication pass over one or more layers
+type DedupStats struct {
+	Files     int   // regular files examined
+	Linked    int   // files replaced by a link to an existing object
+	Reclaimed int64 // bytes no longer stored twice
+}
+
+func (s *DedupStats) add(o DedupStats) {
+	s.Files += o.Files
+	s.Linked += o.Linked
+	s.Reclaimed += o.Reclaimed
+}
+
+// Dedup runs every sealed layer of every ref through the object store.
+// Upper layers are skipped: overlayfs writes to them in place, which would
+// corrupt a shared object.
+func (gt *GoTree) Dedup(mode string) (DedupStats, error) {
+	var stats DedupStats
+
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return stats, err
+	}
+
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		for _, layerID := range ref.Layers {
+			if seen[layerID] {
+				continue
+			}
+			seen[layerID] = true
+
+			s, err := gt.dedupLayer(layerID, mode)
+			stats.add(s)
+			if err != nil {
+				return stats, fmt.Errorf("failed to deduplicate %s: %w", layerID, err)
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// dedupLayer links each regular file of a sealed layer to its object,
+// adding the file to the store when no object exists yet. In hardlink mode
+// the file and the object share an inode, so the mtime of the object wins.
+func (gt *GoTree) dedupLayer(layerID, mode string) (DedupStats, error) {
+	var stats DedupStats
+	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+
+	err := filepath.Walk(layerPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		stats.Files++
+
+		key, err := objectKey(p, info)
+		if err != nil {
+			return err
+		}
+		objPath := gt.objectPath(key)
+
+		objInfo, err := os.Lstat(objPath)
+		if os.IsNotExist(err) {
+			return gt.storeObject(p, objPath, mode)
+		}
+		if err != nil {
+			return err
+		}
+		if os.SameFile(info, objInfo) {
+			return nil
+		}
+
+		if err := replaceWithObject(p, objPath, info, mode); err != nil {
+			if err == syscall.EMLINK {
+				return nil // object has too many links, keep the copy
+			}
+			return err
+		}
+		stats.Linked++
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink == 1 {
+			stats.Reclaimed += info.Size()
+		}
+		return nil
+	})
+
+	return stats, err
+}
+
+// storeObject adds the file at p to the object store
+func (gt *GoTree) storeObject(p, objPath, mode string) error {
+	if err := os.MkdirAll(filepath.Dir(objPath), 0755); err != nil {
+		return err
+	}
+	if mode == "reflink" {
+		if err := reflinkFile(p, objPath, 0444); err != nil {
+			return fmt.Errorf("reflink not supported here: %w", err)
+		}
+		return nil
+	}
+	return os.Link(p, objPath)
+}
+
+// replaceWithObject atomically swaps the file at p for a link to objPath
+func replaceWithObject(p, objPath string, info os.FileInfo, mode string) error {
+	tmp := p + ".gotree-dedup"
+	if mode == "reflink" {
+		if err := reflinkFile(objPath, tmp, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("reflink not supported here: %w", err)
+		}
+		if err := copyFileAttrs(p, tmp, info); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	} else if err := os.Link(objPath, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// copyFileAttrs gives dst the ownership, mode, xattrs and times of src
+func copyFileAttrs(src, dst string, info os.FileInfo) error {
+	attrs, err := attrsFromInfo(src, info)
+	if err != nil {
+		return err
+	}
+	return attrs.apply(dst)
+}
+
+// objectKey hashes the content of a regular file together with the
+// attributes a hardlink would share, so only truly identical files collide
+func objectKey(p string, info os.FileInfo) (string, error) {
+	h := sha256.New()
+
+	var uid, gid uint32
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		uid, gid = st.Uid, st.Gid
+	}
+	fmt.Fprintf(h, "mode %o uid %d gid %d\n", info.Mode(), uid, gid)
+
+	names, err := xattrNames(p)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		value, err := getXattr(p, name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "xattr %s %x\n", name, value)
+	}
+	h.Write([]byte{0})
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (gt *GoTree) objectPath(key string) string {
+	return filepath.Join(gt.repoPath, "objects", key[:2], key[2:])
+}
+
+// objectInodes returns the inodes of the files in the object store. A
+// layer file linked to an object shares its inode with every identical
+// file, which makes them look like hardlinks of each other when they are
+// not, so copies and archives of layers must not join them up.
+func (gt *GoTree) objectInodes() (map[[2]uint64]bool, error) {
+	inodes := make(map[[2]uint64]bool)
+	err := filepath.Walk(filepath.Join(gt.repoPath, "objects"), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() {
+			inodes[[2]uint64{uint64(st.Dev), st.Ino}] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object store: %w", err)
+	}
+	return inodes, nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OCI image layout media types and annotations
+const (
+	ociLayoutVersion    = "1.0.0"
+	ociIndexMediaType   = "application/vnd.oci.image.index.v1+json"
+	ociManifestType     = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType  = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType   = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociRefNameAnnot     = "org.opencontainers.image.ref.name"
+	gotreeLayerAnnot    = "io.gotree.layer"
+	ociWhiteoutPrefix   = ".wh."
+	ociWhiteoutMeta     = ".wh..wh."
+	ociOpaqueWhiteout   = ".wh..wh..opq"
+	dockerManifestType  = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestIndex = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociImageConfig struct {
+	Created      time.Time `json:"created"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Config       struct {
+		Labels map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []ociHistory `json:"history,omitempty"`
+}
+
+type ociHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// splitOCIRef splits "dir:tag" into the layout directory and the tag
+func splitOCIRef(s string) (string, string) {
+	if i := strings.LastIndex(s, ":"); i > 0 && !strings.Contains(s[i+1:], "/") {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// ExportOCI writes a ref as an image in the OCI layout at dir, one tar
+// layer per GoTree layer from the bottom of the parent chain up. Overlay
+// whiteouts become .wh. files and the ref's metadata becomes image labels.
+func (gt *GoTree) ExportOCI(refName, dir, tag string) error {
+	ref, err := gt.getRef(refName)
+	if err != nil {
+		return fmt.Errorf("ref not found: %w", err)
+	}
+	if tag == "" {
+		tag = refName
+	}
+
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+
+	layerIDs := append([]string{ref.LayerID}, gt.lowerLayerIDs(ref)...)
+	objects, err := gt.objectInodes()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+
+	var config ociImageConfig
+	config.Created = now
+	config.Architecture = runtime.GOARCH
+	config.OS = "linux"
+	config.Config.Labels = ref.Metadata
+	config.RootFS.Type = "layers"
+
+	var manifest ociManifest
+	manifest.SchemaVersion = 2
+	manifest.MediaType = ociManifestType
+
+	for i := len(layerIDs) - 1; i >= 0; i-- {
+		layerID := layerIDs[i]
+		desc, diffID, err := writeOCILayer(filepath.Join(gt.repoPath, "layers", layerID), blobsDir, objects)
+		if err != nil {
+			return fmt.Errorf("failed to export layer %s: %w", layerID, err)
+		}
+		desc.Annotations = map[string]string{gotreeLayerAnnot: layerID}
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		config.History = append(config.History, ociHistory{Created: now, CreatedBy: "gotree layer " + layerID})
+	}
+
+	manifest.Config, err = writeOCIJSON(blobsDir, ociConfigMediaType, config)
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := writeOCIJSON(blobsDir, ociManifestType, manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{ociRefNameAnnot: tag}
+	manifestDesc.Platform = &ociPlatform{Architecture: config.Architecture, OS: config.OS}
+
+	// Keep the other images of an existing layout, replacing this tag
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType}
+	if data, err := os.ReadFile(filepath.Join(dir, "index.json")); err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to parse existing index.json: %w", err)
+		}
+	}
+	var manifests []ociDescriptor
+	for _, m := range index.Manifests {
+		if m.Annotations[ociRefNameAnnot] != tag {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = append(manifests, manifestDesc)
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), data, 0644); err != nil {
+		return err
+	}
+	layout := fmt.Sprintf("{\"imageLayoutVersion\":\"%s\"}", ociLayoutVersion)
+	return os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(layout), 0644)
+}
+
+// writeOCILayer archives one layer directory as a gzip blob and returns its
+// descriptor and the digest of the uncompressed tar (its diff ID)
+func writeOCILayer(layerPath, blobsDir string, objects map[[2]uint64]bool) (ociDescriptor, string, error) {
+	tmp, err := os.CreateTemp(blobsDir, ".layer-")
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	blobHash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, blobHash)}
+	gz := gzip.NewWriter(counter)
+	diffHash := sha256.New()
+	tb := newTarBuilder(io.MultiWriter(gz, diffHash), objects)
+
+	err = filepath.Walk(layerPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layerPath, p)
+		if err != nil {
+			return err
+		}
+
+		if isWhiteout(info) {
+			dir, name := filepath.Split(rel)
+			return tb.addEmptyFile(filepath.Join(dir, ociWhiteoutPrefix+name), info)
+		}
+		if err := tb.add(rel, p, info, 0); err != nil {
+			return err
+		}
+		if info.IsDir() && isOpaque(p) {
+			return tb.addEmptyFile(filepath.Join(rel, ociOpaqueWhiteout), info)
+		}
+		return nil
+	})
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := tb.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+
+	digest := hex.EncodeToString(blobHash.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(blobsDir, digest)); err != nil {
+		return ociDescriptor{}, "", err
+	}
+
+	desc := ociDescriptor{MediaType: ociLayerMediaType, Digest: "sha256:" + digest, Size: counter.n}
+	return desc, "sha256:" + hex.EncodeToString(diffHash.Sum(nil)), nil
+}
+
+// writeOCIJSON stores v as a JSON blob and returns its descriptor
+func writeOCIJSON(blobsDir, mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(blobsDir, digest), data, 0644); err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(data))}, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// addEmptyFile writes an empty regular file entry, used for OCI whiteouts
+func (tb *tarBuilder) addEmptyFile(name string, info os.FileInfo) error {
+	return tb.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		ModTime:  info.ModTime(),
+		Format:   tar.FormatPAX,
+	})
+}
+
+// ImportOCI turns an image from the OCI layout at dir into a chain of refs,
+// one per image layer, linked by Parent. The top layer becomes ref name;
+// the layers below it become name-layer1, name-layer2 and so on from the
+// bottom. An empty tag selects the only image in the layout.
+func (gt *GoTree) ImportOCI(name, dir, tag string) error {
+	if err := gt.validateRefName(name); err != nil {
+		return err
+	}
+
+	manifest, config, err := readOCIImage(dir, tag)
+	if err != nil {
+		return err
+	}
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("image has no layers")
+	}
+
+	names := make([]string, len(manifest.Layers))
+	for i := range manifest.Layers {
+		names[i] = fmt.Sprintf("%s-layer%d", name, i+1)
+	}
+	names[len(names)-1] = name
+	for _, n := range names {
+		if _, err := gt.getRef(n); err == nil {
+			return fmt.Errorf("ref '%s' already exists", n)
+		}
+	}
+
+	// Undo everything on failure so no half-imported chain is left behind
+	var created []string
+	var layers []string
+	rollback := func() {
+		for _, n := range created {
+			gt.removeRef(n, "import rollback")
+		}
+		for _, l := range layers {
+			os.RemoveAll(l)
+		}
+	}
+
+	parent := ""
+	for i, desc := range manifest.Layers {
+		layerID := gt.generateLayerID()
+		layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+		layers = append(layers, layerPath)
+		if err := os.MkdirAll(layerPath, 0755); err != nil {
+			rollback()
+			return fmt.Errorf("failed to create layer: %w", err)
+		}
+		if err := extractOCILayer(dir, desc, layerPath); err != nil {
+			rollback()
+			return fmt.Errorf("failed to import layer %s: %w", desc.Digest, err)
+		}
+
+		metadata := map[string]string{"oci.layer": desc.Digest}
+		if i == len(manifest.Layers)-1 {
+			inheritMetadata(metadata, config.Config.Labels)
+		}
+
+		ref := Ref{
+			Name:      names[i],
+			Parent:    parent,
+			LayerID:   layerID,
+			CreatedAt: time.Now(),
+			Metadata:  metadata,
+		}
+		if err := gt.saveRef(ref, "import oci "+desc.Digest); err != nil {
+			rollback()
+			return err
+		}
+		created = append(created, names[i])
+		parent = names[i]
+	}
+
+	return nil
+}
+
+// readOCIImage finds the image manifest for tag in an OCI layout and loads
+// its config
+func readOCIImage(dir, tag string) (*ociManifest, *ociImageConfig, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("not an OCI layout: %w", err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse index.json: %w", err)
+	}
+
+	var desc *ociDescriptor
+	var tags []string
+	for i, m := range index.Manifests {
+		t := m.Annotations[ociRefNameAnnot]
+		tags = append(tags, t)
+		if (tag != "" && t == tag) || (tag == "" && len(index.Manifests) == 1) {
+			desc = &index.Manifests[i]
+		}
+	}
+	if desc == nil {
+		sort.Strings(tags)
+		if tag == "" {
+			return nil, nil, fmt.Errorf("layout holds several images, pick one of: %s", strings.Join(tags, ", "))
+		}
+		return nil, nil, fmt.Errorf("tag %s not found, available: %s", tag, strings.Join(tags, ", "))
+	}
+
+	// A multi-platform index points at one manifest per platform
+	for desc.MediaType == ociIndexMediaType || desc.MediaType == dockerManifestIndex {
+		var nested ociIndex
+		if err := readOCIBlobJSON(dir, *desc, &nested); err != nil {
+			return nil, nil, err
+		}
+		var match *ociDescriptor
+		for i, m := range nested.Manifests {
+			if m.Platform == nil || (m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH) {
+				match = &nested.Manifests[i]
+				break
+			}
+		}
+		if match == nil {
+			return nil, nil, fmt.Errorf("image has no manifest for linux/%s", runtime.GOARCH)
+		}
+		desc = match
+	}
+	if desc.MediaType != ociManifestType && desc.MediaType != dockerManifestType {
+		return nil, nil, fmt.Errorf("unsupported manifest type %s", desc.MediaType)
+	}
+
+	var manifest ociManifest
+	if err := readOCIBlobJSON(dir, *desc, &manifest); err != nil {
+		return nil, nil, err
+	}
+	var config ociImageConfig
+	if err := readOCIBlobJSON(dir, manifest.Config, &config); err != nil {
+		return nil, nil, err
+	}
+	return &manifest, &config, nil
+}
+
+func readOCIBlobJSON(dir string, desc ociDescriptor, v interface{}) error {
+	f, err := openOCIBlob(dir, desc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if err := f.Verify(); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ociBlob reads a blob while checking it against its digest
+type ociBlob struct {
+	*os.File
+	h      hash.Hash
+	digest string
+}
+
+func openOCIBlob(dir string, desc ociDescriptor) (*ociBlob, error) {
+	algo, digest, ok := strings.Cut(desc.Digest, ":")
+	if !ok || algo != "sha256" || len(digest) != 64 || strings.ContainsAny(digest, "/.") {
+		return nil, fmt.Errorf("unsupported digest %q", desc.Digest)
+	}
+	f, err := os.Open(filepath.Join(dir, "blobs", algo, digest))
+	if err != nil {
+		return nil, err
+	}
+	return &ociBlob{File: f, h: sha256.New(), digest: digest}, nil
+}
+
+func (b *ociBlob) Read(p []byte) (int, error) {
+	n, err := b.File.Read(p)
+	b.h.Write(p[:n])
+	return n, err
+}
+
+// Verify checks the digest of everything read so far
+func (b *ociBlob) Verify() error {
+	if got := hex.EncodeToString(b.h.Sum(nil)); got != b.digest {
+		return fmt.Errorf("blob sha256:%s is corrupt (got sha256:%s)", b.digest, got)
+	}
+	return nil
+}
+
+// extractOCILayer unpacks one image layer into layerPath, turning .wh.
+// files into overlay whiteouts and .wh..wh..opq into opaque directories
+func extractOCILayer(dir string, desc ociDescriptor, layerPath string) error {
+	blob, err := openOCIBlob(dir, desc)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	r, err := decompressReader(blob)
+	if err != nil {
+		return err
+	}
+
+	err = extractTarWith(r, layerPath, func(rel string, hdr *tar.Header) (string, error) {
+		parent, name := filepath.Split(rel)
+		if !strings.HasPrefix(name, ociWhiteoutPrefix) {
+			return rel, nil
+		}
+
+		parentPath, err := safeJoin(layerPath, filepath.Clean(parent))
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(parentPath, 0755); err != nil {
+			return "", err
+		}
+		if name == ociOpaqueWhiteout {
+			return "", setXattr(parentPath, opaqueXattr, []byte("y"))
+		}
+		if strings.HasPrefix(name, ociWhiteoutMeta) {
+			return "", nil // other .wh..wh. entries are private to the image tool
+		}
+		return "", makeWhiteout(filepath.Join(parentPath, strings.TrimPrefix(name, ociWhiteoutPrefix)))
+	})
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	// Drain the rest so the digest covers the whole blob
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		r.Close()
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, blob); err != nil {
+		return err
+	}
+	return blob.Verify()
+}
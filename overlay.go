@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Overlayfs marks deleted entries of lower layers with a 0/0 character
+// device (a whiteout) and directories that hide everything below them with
+// the opaque xattr.
+const opaqueXattr = "trusted.overlay.opaque"
+
+// isWhiteout reports whether info describes an overlayfs whiteout
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// isOpaque reports whether the directory at path is an opaque overlay dir
+func isOpaque(path string) bool {
+	value, err := getXattr(path, opaqueXattr)
+	return err == nil && string(value) == "y"
+}
+
+// isOverlayXattr reports whether name is private to overlayfs and must not
+// leak into exported trees
+func isOverlayXattr(name string) bool {
+	return strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.")
+}
+
+// mergedFunc is called for each entry of a merged view. rel is the path
+// relative to the root ("." for the root itself), path is the file that
+// provides the entry and layer is the index of the layer it comes from.
+// Returning filepath.SkipDir for a directory skips its contents.
+type mergedFunc func(rel, path string, info os.FileInfo, layer int) error
+
+// walkMerged visits the merged view of an overlay stack in lexical order,
+// the way overlayfs would present it. layers lists the layer directories,
+// topmost first. Whiteouts and everything hidden by them or by opaque
+// directories are not visited.
+func walkMerged(layers []string, fn mergedFunc) error {
+	if len(layers) == 0 {
+		return nil
+	}
+
+	info, err := os.Lstat(layers[0])
+	if err != nil {
+		return err
+	}
+	if err := fn(".", layers[0], info, 0); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	dirs := make([]mergedDir, len(layers))
+	for i, layer := range layers {
+		dirs[i] = mergedDir{path: layer, layer: i}
+	}
+	if isOpaque(layers[0]) {
+		dirs = dirs[:1]
+	}
+	return walkMergedDir(".", dirs, fn)
+}
+
+// mergedDir is one layer's copy of a directory in the merged view
+type mergedDir struct {
+	path  string
+	layer int
+}
+
+func walkMergedDir(rel string, dirs []mergedDir, fn mergedFunc) error {
+	type mergedEntry struct {
+		path  string
+		info  os.FileInfo
+		layer int
+		lower []mergedDir
+	}
+
+	seen := make(map[string]bool)
+	entries := make(map[string]*mergedEntry)
+	for i, dir := range dirs {
+		names, err := readDirNames(dir.path)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			p := filepath.Join(dir.path, name)
+			info, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+			if isWhiteout(info) {
+				continue
+			}
+
+			e := &mergedEntry{path: p, info: info, layer: dir.layer}
+			if info.IsDir() && !isOpaque(p) {
+				// Directories merge with same-named directories below until
+				// a non-directory, a whiteout or an opaque directory
+				for _, lower := range dirs[i+1:] {
+					lp := filepath.Join(lower.path, name)
+					li, err := os.Lstat(lp)
+					if os.IsNotExist(err) {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					if !li.IsDir() {
+						break
+					}
+					e.lower = append(e.lower, mergedDir{path: lp, layer: lower.layer})
+					if isOpaque(lp) {
+						break
+					}
+				}
+			}
+			entries[name] = e
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := entries[name]
+		childRel := name
+		if rel != "." {
+			childRel = rel + "/" + name
+		}
+
+		err := fn(childRel, e.path, e.info, e.layer)
+		if err == filepath.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if e.info.IsDir() {
+			children := append([]mergedDir{{path: e.path, layer: e.layer}}, e.lower...)
+			if err := walkMergedDir(childRel, children, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readDirNames returns the names in a directory, or none if it is missing
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// layerPaths turns layer IDs into layer directories
+func (gt *GoTree) layerPaths(layerIDs []string) []string {
+	paths := make([]string, len(layerIDs))
+	for i, layerID := range layerIDs {
+		paths[i] = filepath.Join(gt.repoPath, "layers", layerID)
+	}
+	return paths
+}
+
+// refStack returns the layer directories that make up the merged view of a
+// ref, topmost (the upper layer) first
+func (gt *GoTree) refStack(ref *Ref) []string {
+	return gt.layerPaths(append([]string{ref.LayerID}, gt.lowerLayerIDs(ref)...))
+}
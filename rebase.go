@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// RebaseConflict is a path that a ref changes in its own layers and that
+// also differs between its old and new parent. After the rebase the ref's
+// version hides whatever the new parent did to it.
+type RebaseConflict struct {
+	Ref    string `json:"ref"`
+	Path   string `json:"path"`
+	Change string `json:"change"` // how the path differs between the parents
+}
+
+// Rebase moves refs onto a new parent. Their own layers are kept as they
+// are, so overlayfs re-applies them on top of the new parent's merged
+// view; descendants follow along. Paths changed on both sides are
+// returned as conflicts, and unless force is set nothing is changed when
+// there are any.
+func (gt *GoTree) Rebase(refNames []string, newParent string, force bool) ([]RebaseConflict, error) {
+	parentRef, err := gt.getRef(newParent)
+	if err != nil {
+		return nil, fmt.Errorf("new parent ref not found: %w", err)
+	}
+
+	var refs []*Ref
+	var affected []string
+	descendantsOf := make(map[string][]string)
+	for _, name := range refNames {
+		ref, err := gt.getRef(name)
+		if err != nil {
+			return nil, fmt.Errorf("ref not found: %w", err)
+		}
+		descendants, err := gt.descendants(name)
+		if err != nil {
+			return nil, err
+		}
+		if name == newParent || containsString(descendants, newParent) {
+			return nil, fmt.Errorf("cannot rebase '%s' onto '%s': it would make a loop", name, newParent)
+		}
+		refs = append(refs, ref)
+		descendantsOf[name] = descendants
+		affected = append(affected, name)
+		affected = append(affected, descendants...)
+	}
+
+	// The lower layers of every affected ref change under overlayfs' feet
+	for _, name := range affected {
+		mounted, err := gt.IsMountedRef(name)
+		if err != nil {
+			return nil, err
+		}
+		if mounted {
+			return nil, fmt.Errorf("cannot rebase: ref '%s' is currently mounted", name)
+		}
+	}
+
+	newView, err := readMergedView(gt.refStack(parentRef))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read new parent: %w", err)
+	}
+
+	var conflicts []RebaseConflict
+	parentDiffs := make(map[string][]DiffEntry)
+	for _, ref := range refs {
+		// '@' cannot appear in ref names, so tags get keys of their own
+		base := ref.Parent
+		if base == "" && ref.Tag != "" {
+			base = "@" + ref.Tag
+		}
+		changes, ok := parentDiffs[base]
+		if !ok {
+			var oldStack []string
+			if ref.Parent != "" {
+				oldParent, err := gt.getRef(ref.Parent)
+				if err != nil {
+					return nil, fmt.Errorf("old parent ref not found: %w", err)
+				}
+				oldStack = gt.refStack(oldParent)
+			} else {
+				oldStack = gt.layerPaths(gt.lowerLayerIDs(ref)[len(ref.Layers):])
+			}
+			oldView, err := readMergedView(oldStack)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read old parent: %w", err)
+			}
+			changes, err = diffViews(oldView, newView)
+			if err != nil {
+				return nil, err
+			}
+			parentDiffs[base] = changes
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		// Descendants can hide the parent's changes just as well
+		names := append([]string{ref.Name}, descendantsOf[ref.Name]...)
+		for _, name := range names {
+			owner := ref
+			if name != ref.Name {
+				if owner, err = gt.getRef(name); err != nil {
+					return nil, fmt.Errorf("ref not found: %w", err)
+				}
+			}
+			touched, err := layerChanges(gt.layerPaths(refLayerIDs(owner)))
+			if err != nil {
+				return nil, err
+			}
+			for _, change := range changes {
+				if touchesPath(touched, change.Path) {
+					conflicts = append(conflicts, RebaseConflict{Ref: name, Path: change.Path, Change: change.Change})
+				}
+			}
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Ref != conflicts[j].Ref {
+			return conflicts[i].Ref < conflicts[j].Ref
+		}
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	if len(conflicts) > 0 && !force {
+		return conflicts, fmt.Errorf("%d conflicting paths, nothing was rebased", len(conflicts))
+	}
+
+	// Moving several refs must not stop half way
+	t, err := gt.beginTxn("rebase onto " + newParent)
+	if err != nil {
+		return conflicts, err
+	}
+	for _, ref := range refs {
+		if err := t.changingRef(ref.Name); err != nil {
+			t.rollback()
+			return conflicts, err
+		}
+		ref.Parent = newParent
+		ref.Tag = ""
+		if err := gt.saveRef(*ref, "rebase onto "+newParent); err != nil {
+			t.rollback()
+			return conflicts, fmt.Errorf("failed to save ref '%s': %w", ref.Name, err)
+		}
+	}
+	t.done()
+	return conflicts, nil
+}
+
+// layerChanges lists every path present in a set of layer directories.
+// The value is true when the entry hides what lies below it entirely:
+// anything but a plain directory, including whiteouts and opaque dirs.
+func layerChanges(layers []string) (map[string]bool, error) {
+	touched := make(map[string]bool)
+	for _, layer := range layers {
+		err := filepath.Walk(layer, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(layer, p)
+			if err != nil || rel == "." {
+				return err
+			}
+			touched[rel] = touched[rel] || !info.IsDir() || isOpaque(p)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return touched, nil
+}
+
+// touchesPath reports whether rel, or a directory above it that hides its
+// lower contents, appears in the layer changes
+func touchesPath(touched map[string]bool, rel string) bool {
+	if _, ok := touched[rel]; ok {
+		return true
+	}
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		if touched[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reflogRetention is how long gc keeps the layers and commits of the ref
+// states in a reflog, so that recent changes can still be undone
+const reflogRetention = 30 * 24 * time.Hour
+
+// ReflogEntry records one change of a ref file. Old is null for a ref
+// that was created, New is null for a ref that was deleted.
+type ReflogEntry struct {
+	Time time.Time       `json:"time"`
+	User string          `json:"user"`
+	Op   string          `json:"op"`
+	Old  json.RawMessage `json:"old"`
+	New  json.RawMessage `json:"new"`
+}
+
+// OldRef decodes the state of the ref before the change, nil if it did
+// not exist
+func (e *ReflogEntry) OldRef() (*Ref, error) {
+	return decodeReflogRef(e.Old)
+}
+
+// NewRef decodes the state of the ref after the change, nil if it was
+// deleted
+func (e *ReflogEntry) NewRef() (*Ref, error) {
+	return decodeReflogRef(e.New)
+}
+
+func decodeReflogRef(data json.RawMessage) (*Ref, error) {
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+	var ref Ref
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+func (gt *GoTree) reflogPath(name string) string {
+	return filepath.Join(gt.repoPath, "reflog", filepath.FromSlash(name)+".jsonl")
+}
+
+// appendReflog adds an entry to the journal of a ref. old and new are the
+// raw ref files, nil when there is none.
+func (gt *GoTree) appendReflog(name, op string, old, new []byte) error {
+	entry := ReflogEntry{
+		Time: time.Now(),
+		User: currentUser(),
+		Op:   op,
+		Old:  rawOrNull(old),
+		New:  rawOrNull(new),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reflog entry: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(gt.reflogPath(name)), 0755); err != nil {
+		return fmt.Errorf("failed to create reflog namespace: %w", err)
+	}
+	f, err := os.OpenFile(gt.reflogPath(name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open reflog: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write reflog: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write reflog: %w", err)
+	}
+	return f.Close()
+}
+
+func rawOrNull(data []byte) json.RawMessage {
+	if data == nil {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(data)
+}
+
+// Reflog returns the journal of a ref, newest first. It is kept after
+// the ref is deleted.
+func (gt *GoTree) Reflog(name string) ([]ReflogEntry, error) {
+	f, err := os.Open(gt.reflogPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no reflog for ref '%s'", name)
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ReflogEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry ReflogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("reflog of '%s' is corrupt at line %d: %w", name, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// recentReflogRefs returns the states before and after every change newer
+// than since, across the reflogs of all refs, deleted ones included
+func (gt *GoTree) recentReflogRefs(since time.Time) ([]Ref, error) {
+	dir := filepath.Join(gt.repoPath, "reflog")
+	var refs []Ref
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(p, ".jsonl") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		entries, err := gt.Reflog(filepath.ToSlash(strings.TrimSuffix(rel, ".jsonl")))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Time.Before(since) {
+				break // newest first
+			}
+			for _, decode := range []func() (*Ref, error){entry.OldRef, entry.NewRef} {
+				ref, err := decode()
+				if err != nil {
+					return fmt.Errorf("reflog of '%s' is corrupt: %w", rel, err)
+				}
+				if ref != nil {
+					refs = append(refs, *ref)
+				}
+			}
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// Undo puts a ref back in the state it had before the n-th most recent
+// change in its reflog, recreating it if it has since been deleted or
+// removing it if that change created it. The undo is itself journaled,
+// so it can be undone too.
+func (gt *GoTree) Undo(name string, n int) (*ReflogEntry, error) {
+	entries, err := gt.Reflog(name)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > len(entries) {
+		return nil, fmt.Errorf("ref '%s' has %d reflog entries", name, len(entries))
+	}
+	entry := entries[n-1]
+
+	restored, err := entry.OldRef()
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode reflog entry: %w", err)
+	}
+
+	// Swapping layers under a live overlay mount is not possible, and
+	// children see this ref's layers as their lower layers
+	affected, err := gt.descendants(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range append([]string{name}, affected...) {
+		mounted, err := gt.IsMountedRef(r)
+		if err != nil {
+			return nil, err
+		}
+		if mounted {
+			return nil, fmt.Errorf("cannot undo changes to '%s': ref '%s' is currently mounted", name, r)
+		}
+	}
+
+	op := fmt.Sprintf("undo %s", entry.Op)
+	if restored == nil {
+		if _, err := gt.getRef(name); err != nil {
+			return &entry, nil // already gone
+		}
+		hasChildren, err := gt.HasChildren(name)
+		if err != nil {
+			return nil, err
+		}
+		if hasChildren {
+			return nil, fmt.Errorf("cannot undo the creation of '%s': it has child refs", name)
+		}
+		return &entry, gt.removeRef(name, op)
+	}
+
+	// A deleted ref took its layers to the trash
+	if err := gt.restoreTrashedLayers(name, refLayerIDs(restored)); err != nil {
+		return nil, err
+	}
+	for _, layerID := range refLayerIDs(restored) {
+		if !gt.layerExists(layerID) {
+			return nil, fmt.Errorf("cannot restore '%s': layer %s is gone", name, layerID)
+		}
+	}
+	if restored.Tag != "" {
+		if _, err := gt.getTag(restored.Tag); err != nil {
+			return nil, fmt.Errorf("cannot restore '%s': tag '%s' is gone", name, restored.Tag)
+		}
+	}
+	restored.Name = name
+
+	// Undoing a commit brings back an upper layer that has been sealed
+	// since. Commits, tags, other refs and the object store may share its
+	// files, so it stays sealed and gets a fresh upper layer on top.
+	sealed, err := gt.layerSealed(restored.LayerID)
+	if err != nil {
+		return nil, err
+	}
+	if !sealed {
+		return &entry, gt.saveRef(*restored, op)
+	}
+	layerID := gt.generateLayerID()
+	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+	if err := os.MkdirAll(layerPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create layer: %w", err)
+	}
+	if err := copyDirAttrs(filepath.Join(gt.repoPath, "layers", restored.LayerID), layerPath); err != nil {
+		os.RemoveAll(layerPath)
+		return nil, fmt.Errorf("failed to create layer: %w", err)
+	}
+	restored.Layers = append([]string{restored.LayerID}, restored.Layers...)
+	restored.LayerID = layerID
+	if err := gt.saveRef(*restored, op); err != nil {
+		os.RemoveAll(layerPath)
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// layerSealed reports whether a layer is part of a commit, a tag or the
+// sealed stack of a ref, and so must never be written to again
+func (gt *GoTree) layerSealed(layerID string) (bool, error) {
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return false, err
+	}
+	for _, ref := range refs {
+		if containsString(ref.Layers, layerID) {
+			return true, nil
+		}
+	}
+
+	tagged, err := gt.tagsUsingLayers([]string{layerID})
+	if err != nil {
+		return false, err
+	}
+	if len(tagged) > 0 {
+		return true, nil
+	}
+
+	entries, err := os.ReadDir(filepath.Join(gt.repoPath, "commits"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read commits directory: %w", err)
+	}
+	for _, e := range entries {
+		commit, err := gt.getCommit(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		if commit.LayerID == layerID || containsString(commit.Lower, layerID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
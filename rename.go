@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RenameRef gives a ref a new name. Its children, its reflog and the
+// records of its mounts follow; commits and tags keep the name the ref had
+// when they were made.
+func (gt *GoTree) RenameRef(oldName, newName string) error {
+	ref, err := gt.getRef(oldName)
+	if err != nil {
+		return fmt.Errorf("ref not found: %w", err)
+	}
+	if err := gt.validateRefName(newName); err != nil {
+		return err
+	}
+	if _, err := gt.getRef(newName); err == nil {
+		return fmt.Errorf("ref '%s' already exists", newName)
+	}
+
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return err
+	}
+
+	t, err := gt.beginTxn("rename " + oldName + " to " + newName)
+	if err != nil {
+		return err
+	}
+
+	oldPath := gt.refPath(oldName)
+	oldData, err := os.ReadFile(oldPath)
+	if err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to read ref: %w", err)
+	}
+
+	// The journal entry for the new name is written once the old journal
+	// has moved over, so the history stays in one file
+	ref.Name = newName
+	newData, err := json.MarshalIndent(ref, "", "  ")
+	if err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to marshal ref: %w", err)
+	}
+	if err := t.changingRef(newName); err != nil {
+		t.rollback()
+		return err
+	}
+	newPath := gt.refPath(newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to create ref namespace: %w", err)
+	}
+	if err := writeFileAtomic(newPath, newData, 0644); err != nil {
+		t.rollback()
+		return err
+	}
+
+	for _, child := range refs {
+		if child.Parent != oldName {
+			continue
+		}
+		if err := t.changingRef(child.Name); err != nil {
+			t.rollback()
+			return err
+		}
+		child.Parent = newName
+		if err := gt.saveRef(child, "parent renamed from "+oldName); err != nil {
+			t.rollback()
+			return fmt.Errorf("failed to save ref '%s': %w", child.Name, err)
+		}
+	}
+
+	if err := t.changingRef(oldName); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := os.Remove(oldPath); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to remove ref file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(oldPath)); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to remove ref file: %w", err)
+	}
+	removeEmptyDirs(filepath.Dir(oldPath), filepath.Join(gt.repoPath, "refs"))
+
+	if _, err := os.Stat(gt.reflogPath(oldName)); err == nil {
+		if err := t.moving(gt.reflogPath(oldName), gt.reflogPath(newName)); err != nil {
+			t.rollback()
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(gt.reflogPath(newName)), 0755); err != nil {
+			t.rollback()
+			return fmt.Errorf("failed to move reflog: %w", err)
+		}
+		if err := os.Rename(gt.reflogPath(oldName), gt.reflogPath(newName)); err != nil {
+			t.rollback()
+			return fmt.Errorf("failed to move reflog: %w", err)
+		}
+		removeEmptyDirs(filepath.Dir(gt.reflogPath(oldName)), filepath.Join(gt.repoPath, "reflog"))
+	}
+	t.done()
+
+	if err := gt.appendReflog(newName, "rename from "+oldName, oldData, newData); err != nil {
+		return fmt.Errorf("ref renamed, but %w", err)
+	}
+	if err := gt.renameMountRecords(oldName, newName); err != nil {
+		return fmt.Errorf("ref renamed, but %w", err)
+	}
+	return nil
+}
+
+// renameMountRecords points the mount records of a ref at its new name
+func (gt *GoTree) renameMountRecords(oldName, newName string) error {
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return fmt.Errorf("failed to read mount records: %w", err)
+	}
+
+	for _, rec := range records {
+		if rec.Ref != oldName {
+			continue
+		}
+		rec.Ref = newName
+		if err := gt.saveMountRecord(&rec); err != nil {
+			return fmt.Errorf("failed to update mount record of %s: %w", rec.MountPoint, err)
+		}
+	}
+	return nil
+}
+
+// CopyRef creates dst as an independent copy of src: same parent, history
+// and metadata, but copies of all of src's own layers, so that either ref
+// can change without the other seeing it. Files are reflinked where the
+// filesystem supports it. A commit of the copied layers on top of src's
+// history becomes the head of dst.
+func (gt *GoTree) CopyRef(src, dst string) error {
+	ref, err := gt.getRef(src)
+	if err != nil {
+		return fmt.Errorf("ref not found: %w", err)
+	}
+	if err := gt.validateRefName(dst); err != nil {
+		return err
+	}
+	if _, err := gt.getRef(dst); err == nil {
+		return fmt.Errorf("ref '%s' already exists", dst)
+	}
+
+	// A live upper dir would be copied half way through a change
+	mounted, err := gt.IsMountedRef(src)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return fmt.Errorf("cannot copy ref '%s': it is currently mounted", src)
+	}
+
+	metadata := make(map[string]string)
+	inheritMetadata(metadata, ref.Metadata)
+	copied := Ref{
+		Name:      dst,
+		Parent:    ref.Parent,
+		Tag:       ref.Tag,
+		Head:      ref.Head,
+		CreatedAt: time.Now(),
+		Metadata:  metadata,
+	}
+
+	objects, err := gt.objectInodes()
+	if err != nil {
+		return err
+	}
+	t, err := gt.beginTxn("copy " + src + " to " + dst)
+	if err != nil {
+		return err
+	}
+
+	var layerIDs []string
+	for _, layerID := range refLayerIDs(ref) {
+		newID := gt.generateLayerID()
+		layerPath := filepath.Join(gt.repoPath, "layers", newID)
+		if err := t.creating(layerPath); err != nil {
+			t.rollback()
+			return err
+		}
+		if err := copyTree(filepath.Join(gt.repoPath, "layers", layerID), layerPath, true, objects); err != nil {
+			t.rollback()
+			return fmt.Errorf("failed to copy layer %s: %w", layerID, err)
+		}
+		layerIDs = append(layerIDs, newID)
+	}
+	copied.LayerID = layerIDs[0]
+	copied.Layers = layerIDs[1:]
+
+	// The commits of src point at its own layers, so the copy gets a
+	// commit of the copied ones, on top of src's history
+	copied.Head = ""
+	if ref.Head != "" && len(copied.Layers) > 0 {
+		head := copied
+		head.Head = ref.Head
+		commit, err := gt.newCommit(&head, copied.Layers[0], gt.lowerLayerIDs(&copied)[1:], "copy of "+src, copied.CreatedAt)
+		if err != nil {
+			t.rollback()
+			return err
+		}
+		copied.Head = commit.ID
+	}
+
+	if err := t.changingRef(dst); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := gt.saveRef(copied, "copy of "+src); err != nil {
+		t.rollback()
+		return err
+	}
+
+	t.done()
+	return nil
+}
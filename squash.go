@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Squash merges layers of a ref into a single sealed layer to keep its
+// overlay stack short. With top set to 0, the ref's whole ancestry is
+// flattened and the ref no longer depends on its parent; otherwise only
+// its top sealed layers are merged. With into set, the ref is left alone
+// and the flattened tree, upper layer included, becomes a new ref.
+// The layers that were merged are left for gc, as the history still
+// points to them.
+func (gt *GoTree) Squash(refName, into string, top int) error {
+	ref, err := gt.getRef(refName)
+	if err != nil {
+		return fmt.Errorf("ref not found: %w", err)
+	}
+	if into != "" {
+		return gt.squashInto(ref, into)
+	}
+
+	// Children resolve their lower layers through this ref, and overlayfs
+	// does not allow the lower layers of a live mount to change
+	affected, err := gt.descendants(refName)
+	if err != nil {
+		return err
+	}
+	for _, name := range append([]string{refName}, affected...) {
+		mounted, err := gt.IsMountedRef(name)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			return fmt.Errorf("cannot squash '%s': ref '%s' is currently mounted", refName, name)
+		}
+	}
+
+	var stack []string // layer IDs to merge, topmost first
+	if top > 0 {
+		if top < 2 {
+			return fmt.Errorf("squashing needs at least 2 layers")
+		}
+		if top > len(ref.Layers) {
+			return fmt.Errorf("ref '%s' only has %d sealed layers", refName, len(ref.Layers))
+		}
+		stack = ref.Layers[:top]
+	} else {
+		stack = gt.lowerLayerIDs(ref)
+		if len(stack) == 0 || (len(stack) == 1 && ref.Parent == "" && ref.Tag == "") {
+			return fmt.Errorf("ref '%s' has nothing to squash", refName)
+		}
+	}
+
+	objects, err := gt.objectInodes()
+	if err != nil {
+		return err
+	}
+	staging, err := gt.tempDir("squash-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	tree := filepath.Join(staging, "tree")
+
+	if top > 0 {
+		// Whiteouts must survive, as layers below the squashed ones remain
+		if err := copyTree(filepath.Join(gt.repoPath, "layers", stack[len(stack)-1]), tree, true, objects); err != nil {
+			return fmt.Errorf("failed to squash layers: %w", err)
+		}
+		for i := len(stack) - 2; i >= 0; i-- {
+			if err := applyLayer(filepath.Join(gt.repoPath, "layers", stack[i]), tree); err != nil {
+				return fmt.Errorf("failed to squash layers: %w", err)
+			}
+		}
+	} else if err := flattenStack(gt.layerPaths(stack), tree, objects); err != nil {
+		return fmt.Errorf("failed to squash layers: %w", err)
+	}
+
+	t, err := gt.beginTxn("squash " + refName)
+	if err != nil {
+		return err
+	}
+
+	layerID := gt.generateLayerID()
+	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+	if err := t.creating(layerPath); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := os.Rename(tree, layerPath); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+
+	squashed := *ref
+	if top > 0 {
+		squashed.Layers = append([]string{layerID}, ref.Layers[top:]...)
+	} else {
+		squashed.Parent = ""
+		squashed.Tag = ""
+		squashed.Layers = []string{layerID}
+	}
+
+	message := fmt.Sprintf("Squash %d layers", len(stack))
+	if ref.Parent != "" && squashed.Parent == "" {
+		message += fmt.Sprintf(", detached from '%s'", ref.Parent)
+	} else if ref.Tag != "" && squashed.Tag == "" {
+		message += fmt.Sprintf(", detached from tag '%s'", ref.Tag)
+	}
+	commit, err := gt.newCommit(ref, layerID, gt.lowerLayerIDs(&squashed)[1:], message, time.Now())
+	if err != nil {
+		t.rollback()
+		return err
+	}
+	squashed.Head = commit.ID
+
+	if err := t.changingRef(refName); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := gt.saveRef(squashed, "squash"); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to save ref: %w", err)
+	}
+	t.done()
+	return nil
+}
+
+// squashInto creates a new ref holding the flattened tree of ref as a
+// single sealed layer, with an empty upper layer on top
+func (gt *GoTree) squashInto(ref *Ref, name string) error {
+	if err := gt.validateRefName(name); err != nil {
+		return err
+	}
+	if _, err := gt.getRef(name); err == nil {
+		return fmt.Errorf("ref '%s' already exists", name)
+	}
+
+	// A live upper dir would be flattened half way through a change
+	mounted, err := gt.IsMountedRef(ref.Name)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return fmt.Errorf("cannot squash '%s': it is currently mounted", ref.Name)
+	}
+
+	objects, err := gt.objectInodes()
+	if err != nil {
+		return err
+	}
+	staging, err := gt.tempDir("squash-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	tree := filepath.Join(staging, "tree")
+
+	if err := flattenStack(gt.refStack(ref), tree, objects); err != nil {
+		return fmt.Errorf("failed to squash layers: %w", err)
+	}
+
+	t, err := gt.beginTxn("squash " + ref.Name + " into " + name)
+	if err != nil {
+		return err
+	}
+
+	sealedID := gt.generateLayerID()
+	sealedPath := filepath.Join(gt.repoPath, "layers", sealedID)
+	if err := t.creating(sealedPath); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := os.Rename(tree, sealedPath); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+
+	upperID := gt.generateLayerID()
+	upperPath := filepath.Join(gt.repoPath, "layers", upperID)
+	if err := t.creating(upperPath); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := os.MkdirAll(upperPath, 0755); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+	if err := copyDirAttrs(sealedPath, upperPath); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to create layer: %w", err)
+	}
+
+	metadata := make(map[string]string)
+	inheritMetadata(metadata, ref.Metadata)
+
+	now := time.Now()
+	newRef := Ref{
+		Name:      name,
+		LayerID:   upperID,
+		Layers:    []string{sealedID},
+		CreatedAt: now,
+		Metadata:  metadata,
+	}
+
+	commit, err := gt.newCommit(&newRef, sealedID, nil, fmt.Sprintf("Squash of %s", ref.Name), now)
+	if err != nil {
+		t.rollback()
+		return err
+	}
+	newRef.Head = commit.ID
+
+	if err := t.changingRef(name); err != nil {
+		t.rollback()
+		return err
+	}
+	if err := gt.saveRef(newRef, "squash of "+ref.Name); err != nil {
+		t.rollback()
+		return fmt.Errorf("failed to save ref: %w", err)
+	}
+	t.done()
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tag is a read-only name for one commit of a ref. It keeps the layer
+// stack of that commit, so it stays valid when the ref moves on.
+type Tag struct {
+	Name      string    `json:"name"`
+	Ref       string    `json:"ref"`
+	Commit    string    `json:"commit"`
+	Layers    []string  `json:"layers"` // the commit's layer stack, topmost first
+	Message   string    `json:"message,omitempty"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (gt *GoTree) tagPath(name string) string {
+	return filepath.Join(gt.repoPath, "tags", filepath.FromSlash(name)+".json")
+}
+
+// CreateTag points a new tag at a commit of a ref. spec is a ref name,
+// optionally followed by @ and a commit ID or a unique prefix of one; a
+// bare ref name means its latest commit.
+func (gt *GoTree) CreateTag(name, spec, message string) (*Tag, error) {
+	if err := gt.validateRefName(name); err != nil {
+		return nil, fmt.Errorf("invalid tag name: %w", err)
+	}
+	if _, err := gt.getTag(name); err == nil {
+		return nil, fmt.Errorf("tag '%s' already exists", name)
+	}
+
+	refName, commit, err := gt.resolveCommit(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := &Tag{
+		Name:      name,
+		Ref:       refName,
+		Commit:    commit.ID,
+		Layers:    append([]string{commit.LayerID}, commit.Lower...),
+		Message:   message,
+		Author:    currentUser(),
+		CreatedAt: time.Now(),
+	}
+	for _, layerID := range tag.Layers {
+		if !gt.layerExists(layerID) {
+			return nil, fmt.Errorf("cannot tag commit %s: layer %s is gone", commit.ShortID(), layerID)
+		}
+	}
+
+	// A commit of a child ref stacks on the upper layer its parent had at
+	// the time, which may still be written to
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range refs {
+		if containsString(tag.Layers, r.LayerID) {
+			return nil, fmt.Errorf("cannot tag commit %s: it builds on the writable upper layer of '%s', commit '%s' first", commit.ShortID(), r.Name, r.Name)
+		}
+	}
+
+	data, err := json.MarshalIndent(tag, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tag: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(gt.tagPath(name)), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tag namespace: %w", err)
+	}
+	if err := writeFileAtomic(gt.tagPath(name), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save tag: %w", err)
+	}
+	return tag, nil
+}
+
+// resolveCommit looks up "ref" or "ref@commit" in the history of the ref
+func (gt *GoTree) resolveCommit(spec string) (string, *Commit, error) {
+	refName, id, hasID := strings.Cut(spec, "@")
+	commits, err := gt.Log(refName)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(commits) == 0 {
+		return "", nil, fmt.Errorf("ref '%s' has no commits", refName)
+	}
+	if !hasID {
+		return refName, &commits[0], nil
+	}
+	if id == "" {
+		return "", nil, fmt.Errorf("missing commit ID after '@' in '%s'", spec)
+	}
+
+	var found *Commit
+	for i := range commits {
+		if !strings.HasPrefix(commits[i].ID, id) {
+			continue
+		}
+		if found != nil {
+			return "", nil, fmt.Errorf("commit ID '%s' is ambiguous in the history of '%s'", id, refName)
+		}
+		found = &commits[i]
+	}
+	if found == nil {
+		return "", nil, fmt.Errorf("commit '%s' is not in the history of '%s'", id, refName)
+	}
+	return refName, found, nil
+}
+
+func (gt *GoTree) getTag(name string) (*Tag, error) {
+	data, err := os.ReadFile(gt.tagPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var tag Tag
+	if err := json.Unmarshal(data, &tag); err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// ListTags returns all tags sorted by name
+func (gt *GoTree) ListTags() ([]Tag, error) {
+	names, err := jsonNamesUnder(filepath.Join(gt.repoPath, "tags"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read tags directory: %w", err)
+	}
+
+	var tags []Tag
+	for _, name := range names {
+		tag, err := gt.getTag(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping unreadable tag %s: %v\n", name, err)
+			continue
+		}
+		tags = append(tags, *tag)
+	}
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// DeleteTag removes a tag. Refs created from it and mounts of it keep
+// using its layers, so they have to go first.
+func (gt *GoTree) DeleteTag(name string) error {
+	if _, err := gt.getTag(name); err != nil {
+		return fmt.Errorf("tag not found: %w", err)
+	}
+
+	refs, err := gt.ListRefs()
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if r.Tag == name {
+			return fmt.Errorf("cannot delete tag '%s': ref '%s' was created from it", name, r.Name)
+		}
+	}
+	mountPoints, err := gt.mountPointsForTag(name)
+	if err != nil {
+		return err
+	}
+	if len(mountPoints) > 0 {
+		return fmt.Errorf("cannot delete tag '%s': it is mounted on %s", name, strings.Join(mountPoints, ", "))
+	}
+
+	path := gt.tagPath(name)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove tag: %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(path), filepath.Join(gt.repoPath, "tags"))
+	return nil
+}
+
+// tagsUsingLayers returns the names of the tags whose layer stack
+// includes any of layerIDs
+func (gt *GoTree) tagsUsingLayers(layerIDs []string) ([]string, error) {
+	tags, err := gt.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, tag := range tags {
+		for _, layerID := range layerIDs {
+			if containsString(tag.Layers, layerID) {
+				names = append(names, tag.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// mountPointsForTag returns the recorded mount points of a tag
+func (gt *GoTree) mountPointsForTag(name string) ([]string, error) {
+	records, err := gt.readMountRecords()
+	if err != nil {
+		return nil, err
+	}
+	var mountPoints []string
+	for _, rec := range records {
+		if rec.Tag == name {
+			mountPoints = append(mountPoints, rec.MountPoint)
+		}
+	}
+	return mountPoints, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrashEntry is a deleted ref kept in trash/<id>, with its ref file and
+// the layers it owned, until the trash is emptied
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+	User      string    `json:"user"`
+	Ref       *Ref      `json:"-"`
+}
+
+func (gt *GoTree) trashPath(id string) string {
+	return filepath.Join(gt.repoPath, "trash", id)
+}
+
+// trashRef copies a ref file and moves its layers into a new trash
+// entry, recording each step in t
+func (gt *GoTree) trashRef(t *txn, ref *Ref) (*TrashEntry, error) {
+	now := time.Now()
+	entry := &TrashEntry{
+		ID:        fmt.Sprintf("%s-%s", now.UTC().Format("20060102T150405.000000000"), strings.ReplaceAll(ref.Name, "/", "_")),
+		Name:      ref.Name,
+		DeletedAt: now,
+		User:      currentUser(),
+		Ref:       ref,
+	}
+	dir := gt.trashPath(entry.ID)
+	if err := t.creating(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "layers"), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create trash entry: %w", err)
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal trash entry: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "info.json"), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write trash entry: %w", err)
+	}
+	refData, err := json.MarshalIndent(ref, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ref: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "ref.json"), refData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write trash entry: %w", err)
+	}
+
+	// Layers live on the same filesystem as the trash, so this is a rename
+	for _, layerID := range refLayerIDs(ref) {
+		src := filepath.Join(gt.repoPath, "layers", layerID)
+		dst := filepath.Join(dir, "layers", layerID)
+		if err := t.moving(src, dst); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to move layer %s to the trash: %w", layerID, err)
+		}
+	}
+	return entry, nil
+}
+
+// ListTrash returns the trash entries, newest first
+func (gt *GoTree) ListTrash() ([]TrashEntry, error) {
+	dirs, err := os.ReadDir(filepath.Join(gt.repoPath, "trash"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []TrashEntry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		entry, err := gt.readTrashEntry(d.Name())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping trash entry %s: %v\n", d.Name(), err)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeletedAt.After(entries[j].DeletedAt) })
+	return entries, nil
+}
+
+func (gt *GoTree) readTrashEntry(id string) (*TrashEntry, error) {
+	dir := gt.trashPath(id)
+	data, err := os.ReadFile(filepath.Join(dir, "info.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	entry.ID = id
+
+	data, err = os.ReadFile(filepath.Join(dir, "ref.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entry.Ref); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Restore brings a deleted ref back from the trash. what is either a
+// trash entry ID or a ref name, which picks its most recent deletion.
+func (gt *GoTree) Restore(what string) (*TrashEntry, error) {
+	entries, err := gt.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	var entry *TrashEntry
+	for i := range entries {
+		if entries[i].ID == what || entries[i].Name == what {
+			entry = &entries[i]
+			break
+		}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("'%s' is not in the trash", what)
+	}
+
+	if _, err := gt.getRef(entry.Name); err == nil {
+		return nil, fmt.Errorf("ref '%s' already exists, delete or rename it first", entry.Name)
+	}
+	// The ref would stack on layers that are not there
+	if parent := entry.Ref.Parent; parent != "" {
+		if _, err := gt.getRef(parent); err != nil {
+			return nil, fmt.Errorf("cannot restore '%s': its parent '%s' is gone, restore that first", entry.Name, parent)
+		}
+	}
+	if tag := entry.Ref.Tag; tag != "" {
+		if _, err := gt.getTag(tag); err != nil {
+			return nil, fmt.Errorf("cannot restore '%s': tag '%s' is gone", entry.Name, tag)
+		}
+	}
+
+	t, err := gt.beginTxn("restore " + entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := gt.untrashLayers(t, entry, refLayerIDs(entry.Ref)); err != nil {
+		t.rollback()
+		return nil, err
+	}
+	if err := t.changingRef(entry.Name); err != nil {
+		t.rollback()
+		return nil, err
+	}
+	if err := gt.saveRef(*entry.Ref, "restore "+entry.ID); err != nil {
+		t.rollback()
+		return nil, err
+	}
+	t.done()
+	return entry, os.RemoveAll(gt.trashPath(entry.ID))
+}
+
+// untrashLayers moves layers of a trash entry back into the repository,
+// recording each move in t if there is one. Layers that are not in the
+// entry are skipped.
+func (gt *GoTree) untrashLayers(t *txn, entry *TrashEntry, layerIDs []string) error {
+	for _, layerID := range layerIDs {
+		src := filepath.Join(gt.trashPath(entry.ID), "layers", layerID)
+		if _, err := os.Lstat(src); os.IsNotExist(err) {
+			continue
+		}
+		dst := filepath.Join(gt.repoPath, "layers", layerID)
+		if gt.layerExists(layerID) {
+			return fmt.Errorf("layer %s exists both in the repository and in trash entry %s", layerID, entry.ID)
+		}
+		if t != nil {
+			if err := t.moving(src, dst); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("failed to restore layer %s: %w", layerID, err)
+		}
+	}
+	return nil
+}
+
+// restoreTrashedLayers moves the given layers back from whichever trash
+// entries of ref name hold them, for undoing a deletion from the reflog
+func (gt *GoTree) restoreTrashedLayers(name string, layerIDs []string) error {
+	entries, err := gt.ListTrash()
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].Name != name {
+			continue
+		}
+		if err := gt.untrashLayers(nil, &entries[i], layerIDs); err != nil {
+			return err
+		}
+		names, err := readDirNames(filepath.Join(gt.trashPath(entries[i].ID), "layers"))
+		if err == nil && len(names) == 0 {
+			os.RemoveAll(gt.trashPath(entries[i].ID))
+		}
+	}
+	return nil
+}
+
+// EmptyTrash permanently removes trash entries deleted more than olderThan
+// ago, or all of them when olderThan is 0
+func (gt *GoTree) EmptyTrash(olderThan time.Duration) ([]TrashEntry, error) {
+	entries, err := gt.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []TrashEntry
+	cutoff := time.Now().Add(-olderThan)
+	for _, entry := range entries {
+		if olderThan > 0 && entry.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(gt.trashPath(entry.ID)); err != nil {
+			return removed, fmt.Errorf("failed to remove trash entry %s: %w", entry.ID, err)
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// parseAge parses a duration such as "7d", "12h" or "90m"
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age: %s", s)
+	}
+	return d, nil
+}
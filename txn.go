@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// txn is an intent log for an operation made of several steps. Each step
+// is recorded in txn/<id>.json before it is carried out, so that when the
+// process dies half way the next gotree command can undo the steps that
+// were done. The owner keeps the file flocked, which tells a live
+// transaction from an abandoned one.
+type txn struct {
+	gt   *GoTree
+	path string
+	file *os.File
+
+	Op      string    `json:"op"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Steps   []txnStep `json:"steps"`
+}
+
+// txnStep is one recorded step and how to undo it
+type txnStep struct {
+	Kind string          `json:"kind"`           // "create", "ref" or "move"
+	Path string          `json:"path,omitempty"` // created path, or move destination
+	From string          `json:"from,omitempty"` // move source
+	Ref  string          `json:"ref,omitempty"`  // ref about to be written or removed
+	Old  json.RawMessage `json:"old,omitempty"`  // its previous content, null if it did not exist
+}
+
+// beginTxn starts a transaction for op
+func (gt *GoTree) beginTxn(op string) (*txn, error) {
+	dir := filepath.Join(gt.repoPath, "txn")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create transaction log: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s.json", time.Now().UnixNano(), hex.EncodeToString(suffix)))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction log: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to lock transaction log: %w", err)
+	}
+
+	t := &txn{gt: gt, path: path, file: f, Op: op, PID: os.Getpid(), Started: time.Now()}
+	if err := t.save(); err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// save rewrites the intent log in place; the flock lives on the file, so
+// it cannot be replaced by a rename
+func (t *txn) save() error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal transaction: %w", err)
+	}
+	if err := t.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write transaction log: %w", err)
+	}
+	if _, err := t.file.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to write transaction log: %w", err)
+	}
+	if err := t.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write transaction log: %w", err)
+	}
+	return nil
+}
+
+func (t *txn) record(step txnStep) error {
+	t.Steps = append(t.Steps, step)
+	return t.save()
+}
+
+// creating records that path is about to be created
+func (t *txn) creating(path string) error {
+	return t.record(txnStep{Kind: "create", Path: t.rel(path)})
+}
+
+// changingRef records the current content of a ref about to be written or
+// removed
+func (t *txn) changingRef(name string) error {
+	old, err := os.ReadFile(t.gt.refPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read ref: %w", err)
+	}
+	return t.record(txnStep{Kind: "ref", Ref: name, Old: rawOrNull(old)})
+}
+
+// moving records that from is about to be renamed to to
+func (t *txn) moving(from, to string) error {
+	return t.record(txnStep{Kind: "move", From: t.rel(from), Path: t.rel(to)})
+}
+
+func (t *txn) rel(path string) string {
+	if rel, err := filepath.Rel(t.gt.repoPath, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// done ends a transaction that went through
+func (t *txn) done() {
+	os.Remove(t.path)
+	syncDir(filepath.Dir(t.path))
+	t.close()
+}
+
+// rollback undoes the steps recorded so far, newest first, and ends the
+// transaction. It returns the first error; the log is kept for another
+// attempt in that case.
+func (t *txn) rollback() error {
+	var firstErr error
+	for i := len(t.Steps) - 1; i >= 0; i-- {
+		if err := t.undo(t.Steps[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		t.close()
+		return fmt.Errorf("failed to roll back %s: %w", t.Op, firstErr)
+	}
+	t.done()
+	return nil
+}
+
+func (t *txn) undo(step txnStep) error {
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(t.gt.repoPath, p)
+	}
+
+	switch step.Kind {
+	case "create":
+		return os.RemoveAll(abs(step.Path))
+	case "move":
+		if _, err := os.Lstat(abs(step.Path)); err != nil {
+			return nil // the rename never happened
+		}
+		if _, err := os.Lstat(abs(step.From)); err == nil {
+			return fmt.Errorf("cannot move %s back: %s exists", step.Path, step.From)
+		}
+		return os.Rename(abs(step.Path), abs(step.From))
+	case "ref":
+		current, err := os.ReadFile(t.gt.refPath(step.Ref))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		old, err := decodeReflogRef(step.Old)
+		if err != nil {
+			return err
+		}
+		op := "rollback " + t.Op
+		switch {
+		case old == nil && current == nil:
+			return nil
+		case old == nil:
+			return t.gt.removeRef(step.Ref, op)
+		}
+		// The log re-indents the old ref file when it is saved, so the
+		// bytes differ even when the ref did not change
+		if cur, err := decodeReflogRef(current); err == nil && cur != nil && reflect.DeepEqual(cur, old) {
+			return nil
+		}
+		return t.gt.saveRef(*old, op)
+	}
+	return fmt.Errorf("unknown transaction step %q", step.Kind)
+}
+
+func (t *txn) close() {
+	syscall.Flock(int(t.file.Fd()), syscall.LOCK_UN)
+	t.file.Close()
+}
+
+// recoverTxns rolls back transactions left behind by processes that died.
+// It takes the repository lock exclusively, and only when there is
+// something to roll back.
+func (gt *GoTree) recoverTxns() error {
+	if len(gt.abandonedTxns()) == 0 {
+		return nil
+	}
+
+	lock, err := gt.repoLock(true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	for _, path := range gt.abandonedTxns() {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+			f.Close()
+			continue
+		}
+
+		t := &txn{gt: gt, path: path, file: f}
+		data, err := os.ReadFile(path)
+		if err == nil && len(bytes.TrimSpace(data)) > 0 {
+			err = json.Unmarshal(data, t)
+		}
+		if err != nil {
+			t.close()
+			return fmt.Errorf("transaction log %s is unreadable: %w", path, err)
+		}
+		if err := t.rollback(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Rolled back interrupted %s started %s by pid %d\n",
+			t.Op, t.Started.Format("2006-01-02 15:04:05"), t.PID)
+	}
+	return nil
+}
+
+// abandonedTxns lists the transaction logs that no live process holds
+func (gt *GoTree) abandonedTxns() []string {
+	paths, _ := filepath.Glob(filepath.Join(gt.repoPath, "txn", "*.json"))
+
+	var abandoned []string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			abandoned = append(abandoned, path)
+		}
+		f.Close()
+	}
+	return abandoned
+}
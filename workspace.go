@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MountWorkspace mounts a ref with a workspace layer of its own as the
+// upper dir, on top of the ref's upper layer and the rest of its stack.
+// Overlayfs cannot share an upper dir between mounts, so this is how a
+// ref gets several writable mounts; the ref itself cannot be mounted
+// writable meanwhile, as its upper layer is a lower dir of every
+// workspace. A workspace is merged into the ref with CommitWorkspace.
+func (gt *GoTree) MountWorkspace(refName, mountPoint string) error {
+	ref, err := gt.getRef(refName)
+	if err != nil {
+		return fmt.Errorf("ref not found: %w", err)
+	}
+	mp, err := gt.liveWritableMount(refName)
+	if err != nil {
+		return err
+	}
+	if mp != "" {
+		return fmt.Errorf("ref '%s' is mounted writable on %s; unmount it first", refName, mp)
+	}
+
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	if gt.isMounted(mountPoint) {
+		return fmt.Errorf("mount point already in use")
+	}
+	absPath, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	rec := &mountRecord{Ref: refName, MountPoint: absPath, Mode: "workspace"}
+	if err := gt.newWorkspace(rec, ref); err != nil {
+		return err
+	}
+	if err := gt.mountWorkspace(rec, mountPoint); err != nil {
+		gt.removeWorkspace(rec.Workspace)
+		return err
+	}
+	if err := gt.saveMountRecord(rec); err != nil {
+		syscall.Unmount(mountPoint, 0)
+		gt.removeWorkspace(rec.Workspace)
+		return err
+	}
+	return nil
+}
+
+// newWorkspace creates an empty workspace layer for rec on top of the
+// current stack of ref
+func (gt *GoTree) newWorkspace(rec *mountRecord, ref *Ref) error {
+	layerID := gt.generateLayerID()
+	layerPath := filepath.Join(gt.repoPath, "layers", layerID)
+	if err := os.MkdirAll(layerPath, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace layer: %w", err)
+	}
+	// The root of the merged tree takes its attributes from the upper dir
+	if err := copyDirAttrs(filepath.Join(gt.repoPath, "layers", ref.LayerID), layerPath); err != nil {
+		os.RemoveAll(layerPath)
+		return fmt.Errorf("failed to create workspace layer: %w", err)
+	}
+	rec.Workspace = layerID
+	rec.Layers = append([]string{ref.LayerID}, gt.lowerLayerIDs(ref)...)
+	return nil
+}
+
+// mountWorkspace mounts the layers of a workspace mount record
+func (gt *GoTree) mountWorkspace(rec *mountRecord, mountPoint string) error {
+	upperDir := filepath.Join(gt.repoPath, "layers", rec.Workspace)
+	workDir := filepath.Join(gt.repoPath, "work", rec.Workspace)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return fmt.Errorf("failed to create work directory: %w", err)
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(gt.layerPaths(rec.Layers), ":"), upperDir, workDir)
+	if err := syscall.Mount("overlay", mountPoint, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("failed to mount overlay: %w", err)
+	}
+	return nil
+}
+
+// removeWorkspace deletes a workspace layer and its work dir
+func (gt *GoTree) removeWorkspace(layerID string) error {
+	if err := os.RemoveAll(filepath.Join(gt.repoPath, "work", layerID)); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(gt.repoPath, "layers", layerID))
+}
+
+// workspaceDirty reports whether a workspace layer holds any changes
+func (gt *GoTree) workspaceDirty(layerID string) bool {
+	names, err := readDirNames(filepath.Join(gt.repoPath, "layers", layerID))
+	return err != nil || len(names) > 0
+}
+
+// CommitWorkspace seals the workspace mounted at mountPoint on top of its
+// ref, under the ref's upper layer, and carries on with a fresh workspace
+// on the new stack. Changes left in the ref's own upper layer were made
+// before the workspace was mounted, so they are sealed below it. Other
+// workspaces of the ref do not see the commit until they commit
+// themselves, and where two workspaces changed a path, the one committed
+// last wins.
+func (gt *GoTree) CommitWorkspace(mountPoint, message string) (*Commit, error) {
+	rec, err := gt.readMountRecord(mountPoint)
+	if err != nil || rec.Mode != "workspace" {
+		return nil, fmt.Errorf("%s is not a workspace mount", mountPoint)
+	}
+	ref, err := gt.getRef(rec.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("ref not found: %w", err)
+	}
+
+	wsLayer := rec.Workspace
+	// MountWorkspace keeps writable mounts of the ref away, but a plain
+	// umount and a new mount can get around that
+	mp, err := gt.liveWritableMount(ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	if mp != "" {
+		return nil, fmt.Errorf("cannot commit workspace: ref '%s' is mounted writable on %s, unmount it first", ref.Name, mp)
+	}
+
+	syscall.Sync()
+	if err := syscall.Unmount(mountPoint, 0); err != nil {
+		return nil, fmt.Errorf("cannot commit workspace: %s is busy (%v), close files using it first", mountPoint, err)
+	}
+	restore := func() {
+		gt.mountWorkspace(rec, mountPoint)
+	}
+
+	sealed := *ref
+	sealed.Layers = append([]string{wsLayer}, ref.Layers...)
+	var newUpper string
+	if gt.workspaceDirty(ref.LayerID) {
+		newUpper = gt.generateLayerID()
+		layerPath := filepath.Join(gt.repoPath, "layers", newUpper)
+		if err := os.MkdirAll(layerPath, 0755); err != nil {
+			restore()
+			return nil, fmt.Errorf("failed to create layer: %w", err)
+		}
+		if err := copyDirAttrs(filepath.Join(gt.repoPath, "layers", ref.LayerID), layerPath); err != nil {
+			os.RemoveAll(layerPath)
+			restore()
+			return nil, fmt.Errorf("failed to create layer: %w", err)
+		}
+		sealed.Layers = append([]string{wsLayer, ref.LayerID}, ref.Layers...)
+		sealed.LayerID = newUpper
+	}
+	undo := func() {
+		if newUpper != "" {
+			os.RemoveAll(filepath.Join(gt.repoPath, "layers", newUpper))
+		}
+		restore()
+	}
+
+	if sealed.Metadata == nil {
+		sealed.Metadata = make(map[string]string)
+	}
+	if message != "" {
+		sealed.Metadata["commit.message"] = message
+	}
+
+	now := time.Now()
+	commit, err := gt.newCommit(&sealed, wsLayer, gt.lowerLayerIDs(&sealed)[1:], message, now)
+	if err != nil {
+		undo()
+		return nil, err
+	}
+	sealed.Head = commit.ID
+	sealed.CreatedAt = now
+
+	op := "commit workspace"
+	if message != "" {
+		op += ": " + firstLine(message)
+	}
+	if err := gt.saveRef(sealed, op); err != nil {
+		undo()
+		return nil, fmt.Errorf("failed to save ref: %w", err)
+	}
+
+	// Neither the workspace nor an old upper layer is written to again
+	os.RemoveAll(filepath.Join(gt.repoPath, "work", wsLayer))
+	if newUpper != "" {
+		os.RemoveAll(filepath.Join(gt.repoPath, "work", ref.LayerID))
+	}
+
+	if err := gt.newWorkspace(rec, &sealed); err != nil {
+		os.Remove(rec.path)
+		return commit, fmt.Errorf("committed, but %w", err)
+	}
+	if err := gt.mountWorkspace(rec, mountPoint); err != nil {
+		os.Remove(rec.path)
+		gt.removeWorkspace(rec.Workspace)
+		return commit, fmt.Errorf("committed, but failed to mount a new workspace: %w", err)
+	}
+	if err := gt.saveMountRecord(rec); err != nil {
+		return commit, fmt.Errorf("committed, but %w", err)
+	}
+
+	if gt.config.ObjectStore != "" {
+		sealedLayers := []string{wsLayer}
+		if newUpper != "" {
+			sealedLayers = append(sealedLayers, ref.LayerID)
+		}
+		for _, layerID := range sealedLayers {
+			if _, err := gt.dedupLayer(layerID, gt.config.ObjectStore); err != nil {
+				return commit, fmt.Errorf("committed, but failed to deduplicate layer: %w", err)
+			}
+		}
+	}
+	return commit, nil
+}
+
+// checkWorkspaceCommitted refuses to unmount a workspace that holds
+// changes, as unmounting drops the workspace layer
+func (gt *GoTree) checkWorkspaceCommitted(mountPoint string) error {
+	rec, err := gt.readMountRecord(mountPoint)
+	if err != nil || rec.Mode != "workspace" {
+		return nil
+	}
+	if gt.workspaceDirty(rec.Workspace) {
+		return fmt.Errorf("workspace at %s has uncommitted changes; commit them with 'commit --workspace', keep them as a new ref with --promote or drop them with --discard", mountPoint)
+	}
+	return nil
+}
+
+// DiscardWorkspace unmounts a workspace and drops its changes
+func (gt *GoTree) DiscardWorkspace(mountPoint string, force bool) error {
+	rec, err := gt.readMountRecord(mountPoint)
+	if err != nil || rec.Mode != "workspace" {
+		return fmt.Errorf("%s is not a workspace mount", mountPoint)
+	}
+	if gt.isMounted(mountPoint) {
+		if err := gt.detachMount(mountPoint, force); err != nil {
+			return err
+		}
+	}
+	return gt.forgetMount(mountPoint)
+}